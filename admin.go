@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Admin serves a JSON API to manage devices, networks and tokens
+type Admin struct {
+	*http.Server
+	*http.ServeMux
+	AdminConfig
+	server  *Server
+	reload  func() error
+	started time.Time
+}
+
+type statusResponse struct {
+	Listen   string `json:"listen"`
+	Uptime   string `json:"uptime"`
+	Devices  int    `json:"devices"`
+	Networks int    `json:"networks"`
+	Tokens   int    `json:"tokens"`
+}
+
+type deviceResponse struct {
+	HardwareAddr string     `json:"mac"`
+	Token        string     `json:"token"`
+	Networks     []string   `json:"networks"`
+	Expires      *time.Time `json:"expires,omitempty"`
+	Remaining    string     `json:"remaining,omitempty"`
+}
+
+type networkResponse struct {
+	Name    string `json:"name"`
+	Network string `json:"network"`
+}
+
+type tokenResponse struct {
+	Name         string   `json:"name"`
+	Type         string   `json:"type,omitempty"`
+	Duration     string   `json:"duration,omitempty"`
+	NetworkNames []string `json:"networks"`
+	Disabled     bool     `json:"disabled"`
+	MaxDevices   int      `json:"max_devices,omitempty"`
+	OnLimit      string   `json:"on_limit,omitempty"`
+	Uses         int      `json:"uses,omitempty"`
+	ValidFrom    string   `json:"valid_from,omitempty"`
+	ValidUntil   string   `json:"valid_until,omitempty"`
+	Schedule     []string `json:"schedule,omitempty"`
+	IdleTimeout  string   `json:"idle_timeout,omitempty"`
+	Redirect     string   `json:"redirect,omitempty"`
+	AUPVersion   string   `json:"aup_version,omitempty"`
+}
+
+type extendRequest struct {
+	Duration string `json:"duration"`
+}
+
+type grantRequest struct {
+	Token string `json:"token"`
+}
+
+// NewAdmin creates an admin API for a portal server
+// The reload func is called to reload the config file
+func NewAdmin(c AdminConfig, s *Server, reload func() error) *Admin {
+	a := &Admin{}
+	a.AdminConfig = c
+	a.server = s
+	a.reload = reload
+	a.started = time.Now()
+
+	a.ServeMux = http.NewServeMux()
+	a.HandleFunc("/status", a.Status)
+	a.HandleFunc("/reload", a.Reload)
+	a.HandleFunc("/devices", a.Devices)
+	a.HandleFunc("/devices/", a.Device)
+	a.HandleFunc("/networks", a.Networks)
+	a.HandleFunc("/tokens", a.Tokens)
+	a.HandleFunc("/tokens/", a.Token)
+	a.Handle("/metrics", promhttp.Handler())
+	a.Server = &http.Server{
+		Addr:    c.listen,
+		Handler: http.HandlerFunc(a.Handler),
+	}
+	return a
+}
+
+// ListenAndServeSocket serves the admin API on a unix socket
+// Only root can connect to the socket, so no key is required
+func (a *Admin) ListenAndServeSocket(path string) error {
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return err
+	}
+	return http.Serve(l, a.ServeMux)
+}
+
+// Handler rejects requests from the managed network
+// and requests without the admin key
+func (a *Admin) Handler(w http.ResponseWriter, req *http.Request) {
+	if a.server.IsLocal(req.RemoteAddr) {
+		debugf("rejecting admin request from managed network %s", req.RemoteAddr)
+		writeError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	auth := req.Header.Get("Authorization")
+	key := strings.TrimPrefix(auth, "Bearer ")
+	if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(key), []byte(a.key)) != 1 {
+		debugf("rejecting unauthenticated admin request from %s", req.RemoteAddr)
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	a.ServeMux.ServeHTTP(w, req)
+}
+
+// Status summarizes the running portal
+func (a *Admin) Status(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, statusResponse{
+		Listen:   strings.Join(a.server.listenIPs, ", "),
+		Uptime:   time.Since(a.started).Round(time.Second).String(),
+		Devices:  len(a.server.sessions.Sessions()),
+		Networks: len(a.server.backend.Networks()),
+		Tokens:   len(a.server.Tokens()),
+	})
+}
+
+// Reload reloads the config file, as SIGHUP does
+func (a *Admin) Reload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if err := a.reload(); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Devices lists the authorized devices
+func (a *Admin) Devices(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	devices := []deviceResponse{}
+	for _, session := range a.server.sessions.Sessions() {
+		devices = append(devices, newDeviceResponse(session))
+	}
+	writeJSON(w, http.StatusOK, devices)
+}
+
+// Device grants a device access with POST /devices/<mac>,
+// revokes it with DELETE /devices/<mac>
+// or extends its session with POST /devices/<mac>/extend
+func (a *Admin) Device(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/devices/"), "/")
+	hw, err := net.ParseMAC(parts[0])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && req.Method == "POST":
+		r := grantRequest{}
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		token, ok := a.server.TokenNamed(r.Token)
+		if !ok {
+			writeError(w, http.StatusNotFound, "token not found")
+			return
+		}
+		if token.Disabled {
+			writeError(w, http.StatusConflict, "token is disabled")
+			return
+		}
+		if err := a.server.Authorize(hw, token); errors.Is(err, errDeviceLimit) {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		session, _ := a.server.sessions.Session(hw)
+		writeJSON(w, http.StatusCreated, newDeviceResponse(session))
+
+	case len(parts) == 1 && req.Method == "DELETE":
+		if _, ok := a.server.sessions.Session(hw); !ok {
+			writeError(w, http.StatusNotFound, "device not found")
+			return
+		}
+		if err := a.server.Revoke(hw, "revoked"); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(parts) == 2 && parts[1] == "extend" && req.Method == "POST":
+		r := extendRequest{}
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		d, err := time.ParseDuration(r.Duration)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		session, err := a.server.Extend(hw, d)
+		if err != nil {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, newDeviceResponse(session))
+
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// Networks lists the networks known to the backend
+func (a *Admin) Networks(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	networks := []networkResponse{}
+	for _, n := range a.server.backend.Networks() {
+		networks = append(networks, networkResponse{Name: n.Name, Network: n.String()})
+	}
+	writeJSON(w, http.StatusOK, networks)
+}
+
+// Tokens lists the tokens with GET, or creates one with POST
+// Keys are never listed
+func (a *Admin) Tokens(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		tokens := []tokenResponse{}
+		for _, t := range a.server.Tokens() {
+			tokens = append(tokens, newTokenResponse(t))
+		}
+		writeJSON(w, http.StatusOK, tokens)
+
+	case "POST":
+		t := Token{}
+		if err := json.NewDecoder(req.Body).Decode(&t); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := a.server.AddToken(t); err != nil {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, newTokenResponse(t))
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// Token disables a token with POST /tokens/<name>/disable
+func (a *Admin) Token(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/tokens/"), "/")
+	if len(parts) != 2 || parts[1] != "disable" || req.Method != "POST" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	if err := a.server.DisableToken(parts[0]); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newDeviceResponse(session Session) deviceResponse {
+	d := deviceResponse{
+		HardwareAddr: session.HardwareAddr,
+		Token:        session.Token,
+		Networks:     session.Networks,
+	}
+	if !session.Expires.IsZero() {
+		expires := session.Expires
+		d.Expires = &expires
+		d.Remaining = time.Until(expires).Round(time.Second).String()
+	}
+	return d
+}
+
+func newTokenResponse(t Token) tokenResponse {
+	return tokenResponse{
+		Name:         t.Name,
+		Type:         t.Type,
+		Duration:     t.Duration,
+		NetworkNames: t.NetworkNames,
+		Disabled:     t.Disabled,
+		MaxDevices:   t.MaxDevices,
+		OnLimit:      t.OnLimit,
+		Uses:         t.Uses,
+		ValidFrom:    t.ValidFrom,
+		ValidUntil:   t.ValidUntil,
+		Schedule:     t.Schedule,
+		IdleTimeout:  t.IdleTimeout,
+		Redirect:     t.Redirect,
+		AUPVersion:   t.AUPVersion,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{message})
+}
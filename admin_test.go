@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuthorization(t *testing.T) {
+	c := AdminConfig{listen: "127.0.0.1:0", key: "adminsekrit"}
+	a := NewAdmin(c, &Server{}, nil)
+	a.HandleFunc("/ok", func(w http.ResponseWriter, req *http.Request) {})
+
+	cases := map[string]int{
+		"Bearer adminsekrit": http.StatusOK,
+		"adminsekrit":        http.StatusUnauthorized,
+		"Bearer wrong":       http.StatusUnauthorized,
+		"Basic adminsekrit":  http.StatusUnauthorized,
+		"Bearer ":            http.StatusUnauthorized,
+		"":                   http.StatusUnauthorized,
+	}
+	for auth, status := range cases {
+		req := httptest.NewRequest("GET", "/ok", nil)
+		req.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		a.Handler(w, req)
+		if w.Code != status {
+			t.Errorf("%q got status %d, expected %d", auth, w.Code, status)
+		}
+	}
+}
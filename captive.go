@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// CaptivePath is where the RFC 8908 Captive Portal API is served
+// Hand out its https URI with DHCP option 114 or the RA captive portal option
+const CaptivePath = "/captive-portal/api"
+
+type captiveResponse struct {
+	Captive          bool   `json:"captive"`
+	UserPortalURL    string `json:"user-portal-url"`
+	SecondsRemaining *int64 `json:"seconds-remaining,omitempty"`
+	CanExtendSession bool   `json:"can-extend-session"`
+}
+
+// CaptiveAPI tells the calling device whether it is captive
+// and how long its session has left
+// RFC 8908 requires the portal to be reached over TLS, so it is
+// advertised over HTTPS even with the self-signed certificate
+func (s *Server) CaptiveAPI(w http.ResponseWriter, req *http.Request) {
+	if !s.IsLocal(req.RemoteAddr) {
+		debugf("rejecting non-local captive api request from %s", req.RemoteAddr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if req.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r := captiveResponse{Captive: true, UserPortalURL: s.PortalURL(req, "https", "/")}
+	if hw, err := HardwareAddr(req.RemoteAddr); err == nil && s.backend.HWAddrExists(hw) {
+		r.Captive = false
+		if session, ok := s.sessions.Session(hw); ok && !session.Expires.IsZero() {
+			remaining := int64(time.Until(session.Expires) / time.Second)
+			if remaining < 0 {
+				remaining = 0
+			}
+			r.SecondsRemaining = &remaining
+			r.CanExtendSession = canExtendSession(session)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/captive+json")
+	w.Header().Set("Cache-Control", "private, no-store")
+	json.NewEncoder(w).Encode(r)
+}
+
+// canExtendSession checks if a device can extend its own session
+// Sessions are only extended through the admin API for now
+func canExtendSession(session Session) bool {
+	return false
+}
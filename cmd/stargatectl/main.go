@@ -0,0 +1,192 @@
+// stargatectl manages a running stargate over its control socket.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+var socket string
+
+type status struct {
+	Listen   string `json:"listen"`
+	Uptime   string `json:"uptime"`
+	Devices  int    `json:"devices"`
+	Networks int    `json:"networks"`
+	Tokens   int    `json:"tokens"`
+}
+
+type device struct {
+	HardwareAddr string   `json:"mac"`
+	Token        string   `json:"token"`
+	Networks     []string `json:"networks"`
+	Remaining    string   `json:"remaining"`
+}
+
+type network struct {
+	Name    string `json:"name"`
+	Network string `json:"network"`
+}
+
+const usage = `usage: stargatectl [-socket path] <command>
+
+commands:
+  status
+  devices list
+  devices revoke <mac>
+  devices grant <mac> --token <name>
+  networks list
+  reload
+`
+
+func main() {
+	flag.StringVar(&socket, "socket", "/var/run/stargate.sock", "control socket path")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+
+	if err := run(flag.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "stargatectl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	command := args[0]
+	if len(args) > 1 {
+		command += " " + args[1]
+	}
+
+	switch command {
+	case "status":
+		return printStatus()
+	case "devices list":
+		return listDevices()
+	case "devices revoke":
+		if len(args) != 3 {
+			return errors.New("devices revoke needs a mac address")
+		}
+		return call("DELETE", "/devices/"+args[2], nil, nil)
+	case "devices grant":
+		if len(args) < 3 {
+			return errors.New("devices grant needs a mac address")
+		}
+		fs := flag.NewFlagSet("grant", flag.ExitOnError)
+		token := fs.String("token", "", "token name")
+		fs.Parse(args[3:])
+		if *token == "" {
+			return errors.New("devices grant needs --token")
+		}
+		return call("POST", "/devices/"+args[2], map[string]string{"token": *token}, nil)
+	case "networks list":
+		return listNetworks()
+	case "reload":
+		return call("POST", "/reload", nil, nil)
+	}
+
+	flag.Usage()
+	os.Exit(2)
+	return nil
+}
+
+func printStatus() error {
+	s := status{}
+	if err := call("GET", "/status", nil, &s); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "listen\t%s\n", s.Listen)
+	fmt.Fprintf(w, "uptime\t%s\n", s.Uptime)
+	fmt.Fprintf(w, "devices\t%d\n", s.Devices)
+	fmt.Fprintf(w, "networks\t%d\n", s.Networks)
+	fmt.Fprintf(w, "tokens\t%d\n", s.Tokens)
+	return w.Flush()
+}
+
+func listDevices() error {
+	devices := []device{}
+	if err := call("GET", "/devices", nil, &devices); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "MAC\tTOKEN\tNETWORKS\tREMAINING")
+	for _, d := range devices {
+		remaining := d.Remaining
+		if remaining == "" {
+			remaining = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", d.HardwareAddr, d.Token, strings.Join(d.Networks, ","), remaining)
+	}
+	return w.Flush()
+}
+
+func listNetworks() error {
+	networks := []network{}
+	if err := call("GET", "/networks", nil, &networks); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tNETWORK")
+	for _, n := range networks {
+		fmt.Fprintf(w, "%s\t%s\n", n.Name, n.Network)
+	}
+	return w.Flush()
+}
+
+// call makes a request to stargate over the control socket,
+// decoding the response into out if provided
+func call(method, path string, in, out interface{}) error {
+	body := &bytes.Buffer{}
+	if in != nil {
+		if err := json.NewEncoder(body).Encode(in); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, "http://stargate"+path, body)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		e := struct {
+			Error string `json:"error"`
+		}{}
+		json.NewDecoder(resp.Body).Decode(&e)
+		if e.Error == "" {
+			e.Error = resp.Status
+		}
+		return errors.New(e.Error)
+	}
+
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
+	"html/template"
 	"io/ioutil"
 	"net"
 	"net/url"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ghodss/yaml"
@@ -17,41 +21,76 @@ var (
 	debug bool
 	cfile string
 	pfile string
+	sdir  string
+	sfile string
 )
 
 func init() {
 	flag.BoolVar(&debug, "debug", false, "debug logging")
 	flag.StringVar(&cfile, "config", "/etc/stargate.yaml", "config file path")
 	flag.StringVar(&pfile, "pidfile", "/var/run/stargate.pid", "pid file path")
-	flag.Parse()
+	flag.StringVar(&sdir, "state", "/var/lib/stargate", "state directory path")
+	flag.StringVar(&sfile, "socket", "/var/run/stargate.sock", "control socket path")
 }
 
 var (
 	defaultHTTP     = 7676
 	defaultHTTPS    = 7677
 	defaultRedirect = "https://google.com"
+	defaultBackend  = "iptables"
 	defaultTCP      = []int{}
 	defaultUDP      = []int{67}
+
+	defaultBackoff         = "1s"
+	defaultMaxBackoff      = "10m"
+	defaultLockoutWindow   = "1m"
+	defaultLockoutDuration = "5m"
 )
 
 // Config represents the configuration object
 type Config struct {
-	ListenIP string `json:"listen"`
-	Ports    struct {
+	ListenIP  string `json:"listen"`
+	ListenIP6 string `json:"listen6"`
+	Ports     struct {
 		HTTP  int   `json:"http"`
 		HTTPS int   `json:"https"`
 		TCP   []int `json:"tcp"`
 		UDP   []int `json:"udp"`
 	} `json:"ports"`
-	Redirect string `json:"redirect"`
-	Nets     []struct {
+	Redirect     string `json:"redirect"`
+	Backend      string `json:"backend"`
+	IPSet        bool   `json:"ipset"`
+	TemplatesDir string `json:"templates_dir"`
+	LocalesDir   string `json:"locales_dir"`
+	Admin        struct {
+		Listen string `json:"listen"`
+		Key    string `json:"key"`
+	} `json:"admin"`
+	TLS struct {
+		Cert      string `json:"cert"`
+		Key       string `json:"key"`
+		HTTPLogin *bool  `json:"http_login"`
+	} `json:"tls"`
+	Login struct {
+		Backoff         string `json:"backoff"`
+		MaxBackoff      string `json:"max_backoff"`
+		Lockout         int    `json:"lockout"`
+		LockoutWindow   string `json:"lockout_window"`
+		LockoutDuration string `json:"lockout_duration"`
+	} `json:"login"`
+	Nets []struct {
 		Name string `json:"name"`
 		CIDR string `json:"network"`
 	} `json:"networks"`
-	Tokens []Token `json:"tokens"`
-
-	networks []Network
-	ipnet    *net.IPNet
+	Tokens  []Token  `json:"tokens"`
+	Portals []Portal `json:"portals"`
+
+	networks    []Network
+	ipnets      []*net.IPNet
+	certificate tls.Certificate
+	limits      LimiterConfig
+	templates   *template.Template
+	catalog     *Catalog
 }
 
 // BackendConfig configures the portal backends
@@ -62,8 +101,25 @@ type BackendConfig struct {
 		TCP   []int
 		UDP   []int
 	}
-	net string
-	ip  string
+	net   string
+	ip    string
+	ipv6  bool
+	ipset bool
+}
+
+// AdminConfig configures the admin API
+type AdminConfig struct {
+	listen string
+	key    string
+}
+
+// LimiterConfig configures the backoff after failed logins
+type LimiterConfig struct {
+	backoff         time.Duration
+	maxBackoff      time.Duration
+	lockout         int
+	lockoutWindow   time.Duration
+	lockoutDuration time.Duration
 }
 
 // ServerConfig configures the portal server
@@ -72,10 +128,18 @@ type ServerConfig struct {
 		HTTP  string
 		HTTPS string
 	}
-	listenIP string
-	redirect string
-	localnet *net.IPNet
-	tokens   []Token
+	listenIPs   []string
+	redirect    string
+	localnets   []*net.IPNet
+	tokens      []Token
+	certificate tls.Certificate
+	selfSigned  bool
+	httpLogin   bool
+	limits      LimiterConfig
+	templates   *template.Template
+	static      string
+	portals     []Portal
+	catalog     *Catalog
 }
 
 // ParseConfig parses file configuration and returns a Config
@@ -124,39 +188,187 @@ func (c *Config) applyDefaults() {
 	if len(c.Ports.UDP) == 0 {
 		c.Ports.UDP = defaultUDP
 	}
-	if c.Redirect != "" {
+	if c.Redirect == "" {
 		c.Redirect = defaultRedirect
 	}
+	if c.Backend == "" {
+		c.Backend = defaultBackend
+	}
+	if c.TLS.HTTPLogin == nil {
+		httpLogin := true
+		c.TLS.HTTPLogin = &httpLogin
+	}
+	if c.Login.Backoff == "" {
+		c.Login.Backoff = defaultBackoff
+	}
+	if c.Login.MaxBackoff == "" {
+		c.Login.MaxBackoff = defaultMaxBackoff
+	}
+	if c.Login.LockoutWindow == "" {
+		c.Login.LockoutWindow = defaultLockoutWindow
+	}
+	if c.Login.LockoutDuration == "" {
+		c.Login.LockoutDuration = defaultLockoutDuration
+	}
 }
 
 // Validate the raw input from the config file
 func (c *Config) validate() error {
+	if c.ListenIP6 != "" {
+		ip, ip6 := net.ParseIP(c.ListenIP), net.ParseIP(c.ListenIP6)
+		if ip == nil || ip.To4() == nil {
+			return errors.New("listen6 requires an IPv4 listen address")
+		}
+		if ip6 == nil || ip6.To4() != nil {
+			return errors.New("listen6 address can't be parsed as an IPv6 address")
+		}
+	}
+
 	if err := c.parseNetworks(); err != nil {
 		return err
 	}
+	for _, n := range c.networks {
+		if !c.listensOn(n.IP.To4() == nil) {
+			return fmt.Errorf("network %s has no listen address of the same IP version", n.Name)
+		}
+	}
 
 	if err := c.parseTokens(); err != nil {
 		return err
 	}
 
+	if err := c.parsePortals(); err != nil {
+		return err
+	}
+
 	if _, err := url.Parse(c.Redirect); err != nil {
 		return err
 	}
 
+	if err := c.parseLogin(); err != nil {
+		return err
+	}
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return errors.New("tls cert and key must be configured together")
+	}
+
+	if !*c.TLS.HTTPLogin && c.TLS.Cert == "" {
+		return errors.New("http login can only be disabled with a tls cert")
+	}
+
+	if c.Admin.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Admin.Listen); err != nil {
+			return err
+		}
+		if c.Admin.Key == "" {
+			return errors.New("admin api requires a key")
+		}
+	}
+
+	switch c.Backend {
+	case "iptables", "nftables":
+	default:
+		return fmt.Errorf("unknown backend %s", c.Backend)
+	}
+
+	if c.IPSet {
+		if c.Backend != "iptables" {
+			return errors.New("ipset mode requires the iptables backend")
+		}
+		for _, n := range c.networks {
+			if len(networkSet(n.Name)) > 31 {
+				return fmt.Errorf("network name %s is too long for an ipset", n.Name)
+			}
+		}
+	}
+
 	return nil
 }
 
 // Runtime validation validates the config according to the runtime
 func (c *Config) runtimeValidate() error {
+	c.ipnets = []*net.IPNet{}
+	for _, listen := range c.listenIPs() {
+		ipnet, err := determineIPNet(listen)
+		if err != nil {
+			return err
+		}
+		c.ipnets = append(c.ipnets, ipnet)
+	}
+
 	var err error
-	c.ipnet, err = c.determineIPNet()
-	return err
+	c.certificate, err = c.loadCertificate()
+	if err != nil {
+		return err
+	}
+	c.templates, err = getTemplates(c.TemplatesDir)
+	if err != nil {
+		return err
+	}
+	c.catalog, err = loadCatalog(c.LocalesDir)
+	if err != nil {
+		return err
+	}
+	for _, p := range c.Portals {
+		if c.templates.Lookup(p.Template) == nil {
+			return fmt.Errorf("portal %s refers to unknown template %s", p.Name, p.Template)
+		}
+	}
+	return c.validateAdmin()
+}
+
+// Verify that the admin API can't be reached from the managed network
+func (c *Config) validateAdmin() error {
+	if c.Admin.Listen == "" {
+		return nil
+	}
+	host, _, _ := net.SplitHostPort(c.Admin.Listen)
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errors.New("admin listen address can't be parsed as ip:port")
+	}
+	if ip.IsUnspecified() {
+		return errors.New("admin listen address is reachable from the managed network")
+	}
+	for _, ipnet := range c.ipnets {
+		if ipnet.Contains(ip) {
+			return errors.New("admin listen address is reachable from the managed network")
+		}
+	}
+	return nil
+}
+
+// The addresses to listen on, with the IPv4 address first on dual-stack
+func (c *Config) listenIPs() []string {
+	if c.ListenIP6 == "" {
+		return []string{c.ListenIP}
+	}
+	return []string{c.ListenIP, c.ListenIP6}
+}
+
+// Check if there is an IPv6 or IPv4 listen address
+func (c *Config) listensOn(ipv6 bool) bool {
+	for _, listen := range c.listenIPs() {
+		if (net.ParseIP(listen).To4() == nil) == ipv6 {
+			return true
+		}
+	}
+	return false
+}
+
+// Load the configured certificate, or generate a self-signed one
+func (c *Config) loadCertificate() (tls.Certificate, error) {
+	if c.TLS.Cert == "" {
+		return selfSignedCertificate(c.listenIPs())
+	}
+	return tls.LoadX509KeyPair(c.TLS.Cert, c.TLS.Key)
 }
 
 // Verify that the provided listen addr is bound to an interface
 // and return the *net.IPNet struct
-func (c *Config) determineIPNet() (*net.IPNet, error) {
-	ip := net.ParseIP(c.ListenIP)
+func determineIPNet(listen string) (*net.IPNet, error) {
+	ip := net.ParseIP(listen)
 	if ip == nil {
 		return nil, errors.New("listen address can't be parsed as ip:host")
 	}
@@ -204,26 +416,237 @@ func (c *Config) parseNetworks() error {
 
 // Parse the tokens supplied in the file input
 func (c *Config) parseTokens() error {
-	for i, t := range c.Tokens {
-		if t.Duration != "" {
-			d, err := time.ParseDuration(t.Duration)
-			if err != nil {
-				return err
+	return parseTokens(c.Tokens, c.networks)
+}
+
+// Parse and verify a list of tokens, from the file input
+// or with a token added at runtime
+func parseTokens(tokens []Token, networks []Network) error {
+	names := map[string]bool{}
+	for i := range tokens {
+		if err := tokens[i].parse(); err != nil {
+			return err
+		}
+		if err := tokens[i].validateNetworks(networks); err != nil {
+			return err
+		}
+		if names[tokens[i].Name] {
+			return fmt.Errorf("token %s already exists", tokens[i].Name)
+		}
+		names[tokens[i].Name] = true
+	}
+	return nil
+}
+
+// Verify that a token only grants access to known networks
+func (t *Token) validateNetworks(networks []Network) error {
+	for _, name := range t.NetworkNames {
+		found := false
+		for _, n := range networks {
+			if n.Name == name {
+				found = true
+				break
 			}
-			c.Tokens[i].duration = d
+		}
+		if !found {
+			return fmt.Errorf("token %s refers to unknown network %s", t.Name, name)
 		}
 	}
 	return nil
 }
 
-// Construct a backend config
-func (c *Config) backendConfig() (b BackendConfig) {
-	b.ports.HTTP = c.Ports.HTTP
-	b.ports.HTTPS = c.Ports.HTTPS
-	b.ports.TCP = c.Ports.TCP
-	b.ports.UDP = c.Ports.UDP
-	b.ip = c.ListenIP
-	b.net = c.ipnet.String()
+// Parse the raw fields of a token
+func (t *Token) parse() error {
+	if t.Name == "" {
+		return errors.New("token has no name")
+	}
+	if t.Duration != "" {
+		d, err := time.ParseDuration(t.Duration)
+		if err != nil {
+			return err
+		}
+		t.duration = d
+	}
+	switch t.Type {
+	case "", "key":
+	case "clickthrough":
+		if len(t.Keys) > 0 || t.Uses > 0 {
+			return fmt.Errorf("clickthrough token %s can't have keys or uses", t.Name)
+		}
+	default:
+		return fmt.Errorf("token %s has unknown type %s", t.Name, t.Type)
+	}
+	if t.MaxDevices < 0 {
+		return fmt.Errorf("token %s has a negative max_devices", t.Name)
+	}
+	if t.Redirect != "" {
+		if _, err := url.Parse(t.Redirect); err != nil {
+			return fmt.Errorf("token %s redirect: %v", t.Name, err)
+		}
+	}
+	if t.Uses < 0 {
+		return fmt.Errorf("token %s has negative uses", t.Name)
+	}
+	if t.IdleTimeout != "" {
+		d, err := time.ParseDuration(t.IdleTimeout)
+		if err != nil {
+			return fmt.Errorf("token %s idle_timeout: %v", t.Name, err)
+		}
+		t.idleTimeout = d
+	}
+	if t.ValidFrom != "" {
+		from, err := parseValidity(t.ValidFrom, false)
+		if err != nil {
+			return fmt.Errorf("token %s valid_from: %v", t.Name, err)
+		}
+		t.validFrom = from
+	}
+	if t.ValidUntil != "" {
+		until, err := parseValidity(t.ValidUntil, true)
+		if err != nil {
+			return fmt.Errorf("token %s valid_until: %v", t.Name, err)
+		}
+		t.validUntil = until
+	}
+	t.windows = []Window{}
+	for _, schedule := range t.Schedule {
+		w, err := parseWindow(schedule)
+		if err != nil {
+			return fmt.Errorf("token %s: %v", t.Name, err)
+		}
+		t.windows = append(t.windows, w)
+	}
+	switch t.OnLimit {
+	case "":
+		t.OnLimit = "reject"
+	case "reject", "evict_oldest":
+	default:
+		return fmt.Errorf("token %s has unknown on_limit %s", t.Name, t.OnLimit)
+	}
+	for _, k := range t.Keys {
+		if err := validateKey(k); err != nil {
+			return fmt.Errorf("token %s has a malformed key hash: %v", t.Name, err)
+		}
+	}
+	return nil
+}
+
+// Parse the portals supplied in the file input
+func (c *Config) parsePortals() error {
+	names := map[string]bool{}
+	paths := map[string]bool{}
+	for i := range c.Portals {
+		p := &c.Portals[i]
+		if err := p.parse(); err != nil {
+			return err
+		}
+		if names[p.Name] {
+			return fmt.Errorf("portal %s is configured twice", p.Name)
+		}
+		names[p.Name] = true
+		if p.Path != "" && paths[p.Path] {
+			return fmt.Errorf("portal %s has the path of another portal", p.Name)
+		}
+		paths[p.Path] = true
+		for _, name := range p.TokenNames {
+			found := false
+			for _, t := range c.Tokens {
+				found = found || t.Name == name
+			}
+			if !found {
+				return fmt.Errorf("portal %s refers to unknown token %s", p.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Parse the raw fields of a portal
+func (p *Portal) parse() error {
+	if p.Name == "" {
+		return errors.New("portal has no name")
+	}
+	if p.Path == "" && len(p.Subnets) == 0 {
+		return fmt.Errorf("portal %s needs a path or subnets", p.Name)
+	}
+	if p.Path != "" {
+		p.Path = "/" + strings.Trim(p.Path, "/")
+		if p.Path == "/" {
+			return fmt.Errorf("portal %s can't use the root path", p.Name)
+		}
+		for _, used := range []string{"/logout", "/static", CaptivePath} {
+			if p.Path == used || strings.HasPrefix(p.Path, used+"/") || strings.HasPrefix(used, p.Path+"/") {
+				return fmt.Errorf("portal %s path %s is used by stargate", p.Name, p.Path)
+			}
+		}
+	}
+	p.subnets = []*net.IPNet{}
+	for _, subnet := range p.Subnets {
+		_, ipnet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return fmt.Errorf("portal %s subnet: %v", p.Name, err)
+		}
+		p.subnets = append(p.subnets, ipnet)
+	}
+	if p.Template == "" {
+		p.Template = "index.html"
+	}
+	if p.Redirect != "" {
+		if _, err := url.Parse(p.Redirect); err != nil {
+			return fmt.Errorf("portal %s redirect: %v", p.Name, err)
+		}
+	}
+	return nil
+}
+
+// Parse the login limits supplied in the file input
+func (c *Config) parseLogin() (err error) {
+	l := &c.limits
+	if l.backoff, err = time.ParseDuration(c.Login.Backoff); err != nil {
+		return fmt.Errorf("login backoff: %v", err)
+	}
+	if l.maxBackoff, err = time.ParseDuration(c.Login.MaxBackoff); err != nil {
+		return fmt.Errorf("login max_backoff: %v", err)
+	}
+	if l.lockoutWindow, err = time.ParseDuration(c.Login.LockoutWindow); err != nil {
+		return fmt.Errorf("login lockout_window: %v", err)
+	}
+	if l.lockoutDuration, err = time.ParseDuration(c.Login.LockoutDuration); err != nil {
+		return fmt.Errorf("login lockout_duration: %v", err)
+	}
+	if l.backoff <= 0 || l.maxBackoff < l.backoff {
+		return errors.New("login backoff must be positive and no more than max_backoff")
+	}
+	if c.Login.Lockout < 0 {
+		return errors.New("login lockout can't be negative")
+	}
+	l.lockout = c.Login.Lockout
+	return nil
+}
+
+// Construct a backend config for each listen address
+func (c *Config) backendConfigs() []BackendConfig {
+	configs := []BackendConfig{}
+	for i, listen := range c.listenIPs() {
+		b := BackendConfig{}
+		b.ports.HTTP = c.Ports.HTTP
+		b.ports.HTTPS = c.Ports.HTTPS
+		b.ports.TCP = c.Ports.TCP
+		b.ports.UDP = c.Ports.UDP
+		b.ip = listen
+		b.ipv6 = net.ParseIP(listen).To4() == nil
+		_, ipnet, _ := net.ParseCIDR(c.ipnets[i].String())
+		b.net = ipnet.String()
+		b.ipset = c.IPSet
+		configs = append(configs, b)
+	}
+	return configs
+}
+
+// Construct an admin config
+func (c *Config) adminConfig() (a AdminConfig) {
+	a.listen = c.Admin.Listen
+	a.key = c.Admin.Key
 	return
 }
 
@@ -231,10 +654,20 @@ func (c *Config) backendConfig() (b BackendConfig) {
 func (c *Config) serverConfig() (s ServerConfig) {
 	s.tokens = c.Tokens
 	s.redirect = c.Redirect
-	s.listenIP = c.ListenIP
+	s.listenIPs = c.listenIPs()
 	s.ports.HTTP = strconv.Itoa(c.Ports.HTTP)
 	s.ports.HTTPS = strconv.Itoa(c.Ports.HTTPS)
-	s.localnet = c.ipnet
+	s.localnets = c.ipnets
 	s.redirect = c.Redirect
+	s.certificate = c.certificate
+	s.selfSigned = c.TLS.Cert == ""
+	s.httpLogin = *c.TLS.HTTPLogin
+	s.limits = c.limits
+	s.templates = c.templates
+	s.portals = c.Portals
+	s.catalog = c.catalog
+	if c.TemplatesDir != "" {
+		s.static = filepath.Join(c.TemplatesDir, "static")
+	}
 	return
 }
@@ -8,3 +8,22 @@ func TestConfig(t *testing.T) {
 		t.Errorf("file failed: %v", err)
 	}
 }
+
+func TestParseTokens(t *testing.T) {
+	cases := []struct {
+		tokens []Token
+		ok     bool
+	}{
+		{[]Token{{Name: "guest", Type: "clickthrough"}}, true},
+		{[]Token{{Name: "guest", Type: "clickthrough", Keys: []string{"guess"}}}, false},
+		{[]Token{{Name: "guest", Type: "clickthrough", Uses: 5}}, false},
+		{[]Token{{Name: "guest", Type: "voucher"}}, false},
+		{[]Token{{Name: "office", Keys: []string{"a"}}, {Name: "office", Keys: []string{"b"}}}, false},
+		{[]Token{{Name: "office", NetworkNames: []string{"nowhere"}}}, false},
+	}
+	for _, c := range cases {
+		if err := parseTokens(c.tokens, nil); (err == nil) != c.ok {
+			t.Errorf("%+v parsed with %v, expected ok %v", c.tokens, err, c.ok)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// DualStackBackend drives a backend for each IP version,
+// sending networks to the backend of their version
+// and devices to both
+type DualStackBackend struct {
+	ipv4 Backend
+	ipv6 Backend
+}
+
+// backends returns the configured backends
+func (b *DualStackBackend) backends() []Backend {
+	backends := []Backend{}
+	for _, backend := range []Backend{b.ipv4, b.ipv6} {
+		if backend != nil {
+			backends = append(backends, backend)
+		}
+	}
+	return backends
+}
+
+// family returns the backend for a network's IP version
+func (b *DualStackBackend) family(network Network) (Backend, error) {
+	backend := b.ipv4
+	if network.IP.To4() == nil {
+		backend = b.ipv6
+	}
+	if backend == nil {
+		return nil, fmt.Errorf("no backend for the IP version of network %s", network.Name)
+	}
+	return backend, nil
+}
+
+// Open fulfills the Backend interface
+func (b *DualStackBackend) Open() error {
+	for _, backend := range b.backends() {
+		if err := backend.Open(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close fulfills the Backend interface
+// Every backend is closed, even if one of them fails
+func (b *DualStackBackend) Close() error {
+	errs := []error{}
+	for _, backend := range b.backends() {
+		errs = append(errs, backend.Close())
+	}
+	return firstError(errs...)
+}
+
+// HWAddrExists checks if the specified mac addr is known to the portal
+func (b *DualStackBackend) HWAddrExists(hw net.HardwareAddr) bool {
+	for _, backend := range b.backends() {
+		if backend.HWAddrExists(hw) {
+			return true
+		}
+	}
+	return false
+}
+
+// Devices fulfills the Devices interface
+// Every backend has every device, so the first one's are returned
+func (b *DualStackBackend) Devices() []Device {
+	backends := b.backends()
+	if len(backends) == 0 {
+		return []Device{}
+	}
+	return backends[0].Devices()
+}
+
+// Networks fulfills the ListNetworks interface
+func (b *DualStackBackend) Networks() []Network {
+	networks := []Network{}
+	for _, backend := range b.backends() {
+		networks = append(networks, backend.Networks()...)
+	}
+	return networks
+}
+
+// AddNetwork fulfills the Networks interface
+func (b *DualStackBackend) AddNetwork(network Network) error {
+	backend, err := b.family(network)
+	if err != nil {
+		return err
+	}
+	return backend.AddNetwork(network)
+}
+
+// RemoveNetwork fulfills the Networks interface
+func (b *DualStackBackend) RemoveNetwork(network Network) error {
+	backend, err := b.family(network)
+	if err != nil {
+		return err
+	}
+	return backend.RemoveNetwork(network)
+}
+
+// AddDevice fulfills the Devices interface
+// Each backend only gets the networks it knows about
+// If a backend fails, the device is removed from the others again
+func (b *DualStackBackend) AddDevice(networks []string, device Device) error {
+	added := []Backend{}
+	for _, backend := range b.backends() {
+		if err := backend.AddDevice(networksOf(backend, networks), device); err != nil {
+			for _, a := range added {
+				a.RemoveDevice(device)
+			}
+			return err
+		}
+		added = append(added, backend)
+	}
+	return nil
+}
+
+// RemoveDevice fulfills the Devices interface
+func (b *DualStackBackend) RemoveDevice(device Device) error {
+	errs := []error{}
+	for _, backend := range b.backends() {
+		errs = append(errs, backend.RemoveDevice(device))
+	}
+	return firstError(errs...)
+}
+
+// NetworkCounters fulfills the Counters interface
+// for the backends which do
+func (b *DualStackBackend) NetworkCounters() (map[string]Counter, error) {
+	counters := map[string]Counter{}
+	for _, backend := range b.backends() {
+		c, ok := backend.(Counters)
+		if !ok {
+			continue
+		}
+		stats, err := c.NetworkCounters()
+		if err != nil {
+			return nil, err
+		}
+		for n, stat := range stats {
+			counters[n] = stat
+		}
+	}
+	return counters, nil
+}
+
+// DeviceCounters fulfills the DeviceCounters interface
+// by adding up each device's traffic over the backends which do
+func (b *DualStackBackend) DeviceCounters() (map[string]Counter, error) {
+	counters := map[string]Counter{}
+	for _, backend := range b.backends() {
+		c, ok := backend.(DeviceCounters)
+		if !ok {
+			continue
+		}
+		stats, err := c.DeviceCounters()
+		if err != nil {
+			return nil, err
+		}
+		for hw, stat := range stats {
+			total := counters[hw]
+			total.Packets += stat.Packets
+			total.Bytes += stat.Bytes
+			counters[hw] = total
+		}
+	}
+	return counters, nil
+}
+
+// networksOf filters network names down to those known to a backend
+func networksOf(backend Backend, names []string) []string {
+	known := []string{}
+	for _, name := range names {
+		for _, n := range backend.Networks() {
+			if n.Name == name {
+				known = append(known, name)
+				break
+			}
+		}
+	}
+	return known
+}
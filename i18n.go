@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+// defaultLanguage is the language of the built-in messages,
+// used for messages a catalog doesn't translate
+const defaultLanguage = "en"
+
+// languageCookie remembers the language picked on the portal
+const languageCookie = "stargate_lang"
+
+// defaultMessages are the built-in English messages by ID
+// Messages with arguments are formatted with fmt
+var defaultMessages = map[string]string{
+	"language":          "English",
+	"sign_in_title":     "Sign In",
+	"enter_key":         "enter key",
+	"sign_in":           "sign in",
+	"agree":             "I agree",
+	"continue":          "continue",
+	"signed_in_title":   "Signed In",
+	"signed_in":         "you are signed in",
+	"key":               "key",
+	"networks":          "networks",
+	"time_remaining":    "time remaining",
+	"unlimited":         "unlimited",
+	"sign_out":          "sign out",
+	"error_title":       "Sign In Failed",
+	"try_again":         "try again",
+	"unauthorized":      "unauthorized",
+	"authorized":        "you are authorized",
+	"too_many_attempts": "too many attempts, try again in %s",
+	"key_used_up":       "this key has been used up",
+	"key_inactive":      "this key isn't valid right now",
+	"too_many_devices":  "this key is in use on too many devices",
+	"sign_in_failed":    "sign in failed, please try again",
+	"agree_required":    "please agree to the acceptable use policy",
+	"sign_out_failed":   "sign out failed",
+	"sign_out_retry":    "sign out failed, please try again",
+	"signed_out":        "you are signed out",
+}
+
+// Catalog holds the portal messages of each language by ID
+type Catalog struct {
+	messages map[string]map[string]string
+}
+
+// Language is a language the portal can be shown in,
+// with the URL of the current page in it
+type Language struct {
+	Code    string
+	Name    string
+	URL     string
+	Current bool
+}
+
+// loadCatalog returns the built-in messages along with
+// the translations in dir, one <language>.yaml file per language
+// Translations may leave out messages, but not add unknown ones
+func loadCatalog(dir string) (*Catalog, error) {
+	c := &Catalog{messages: map[string]map[string]string{defaultLanguage: defaultMessages}}
+	if dir == "" {
+		return c, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		messages := map[string]string{}
+		if err := yaml.Unmarshal(data, &messages); err != nil {
+			return nil, fmt.Errorf("locale %s: %v", file, err)
+		}
+		for id := range messages {
+			if _, ok := defaultMessages[id]; !ok {
+				return nil, fmt.Errorf("locale %s has unknown message %s", file, id)
+			}
+		}
+		lang := strings.ToLower(strings.TrimSuffix(filepath.Base(file), ".yaml"))
+		if lang == defaultLanguage {
+			// Rewording the built-in language keeps its missing messages
+			for id, msg := range defaultMessages {
+				if _, ok := messages[id]; !ok {
+					messages[id] = msg
+				}
+			}
+		}
+		c.messages[lang] = messages
+	}
+	return c, nil
+}
+
+// Languages returns the languages of the catalog,
+// the built-in language first
+func (c *Catalog) Languages() []string {
+	langs := []string{}
+	for lang := range c.messages {
+		if lang != defaultLanguage {
+			langs = append(langs, lang)
+		}
+	}
+	sort.Strings(langs)
+	return append([]string{defaultLanguage}, langs...)
+}
+
+// Translate returns a message in a language, falling back to
+// the built-in language and then to the ID itself
+func (c *Catalog) Translate(lang, id string, args ...interface{}) string {
+	if id == "" {
+		return ""
+	}
+	msg, ok := c.messages[lang][id]
+	if !ok {
+		msg, ok = c.messages[defaultLanguage][id]
+	}
+	if !ok {
+		msg = id
+	}
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// Negotiate picks the language for a request: the one picked with
+// the lang parameter or cookie, or else the best of Accept-Language
+func (c *Catalog) Negotiate(req *http.Request) string {
+	if lang := strings.ToLower(req.URL.Query().Get("lang")); c.messages[lang] != nil {
+		return lang
+	}
+	if cookie, err := req.Cookie(languageCookie); err == nil && c.messages[cookie.Value] != nil {
+		return cookie.Value
+	}
+	return c.acceptLanguage(req.Header.Get("Accept-Language"))
+}
+
+// acceptLanguage returns the catalog language with the highest quality
+// in an Accept-Language header, matching "de-AT" to "de" if need be
+func (c *Catalog) acceptLanguage(header string) string {
+	best, bestQ := defaultLanguage, 0.0
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q <= bestQ {
+			continue
+		}
+		for _, lang := range []string{tag, strings.SplitN(tag, "-", 2)[0]} {
+			if c.messages[lang] != nil {
+				best, bestQ = lang, q
+				break
+			}
+		}
+	}
+	return best
+}
+
+// language picks the language for a request, remembering
+// a language picked with the lang parameter in a cookie
+func (s *Server) language(w http.ResponseWriter, req *http.Request) string {
+	s.lock.RLock()
+	catalog := s.catalog
+	s.lock.RUnlock()
+
+	lang := catalog.Negotiate(req)
+	if strings.ToLower(req.URL.Query().Get("lang")) == lang {
+		http.SetCookie(w, &http.Cookie{
+			Name:     languageCookie,
+			Value:    lang,
+			Path:     "/",
+			Expires:  time.Now().AddDate(1, 0, 0),
+			HttpOnly: true,
+		})
+	}
+	return lang
+}
+
+// languages returns the catalog's languages, linking to the current page
+// in each, and carrying along the page the device was after
+func (s *Server) languages(req *http.Request, current string) []Language {
+	s.lock.RLock()
+	catalog := s.catalog
+	s.lock.RUnlock()
+
+	query := url.Values{}
+	if param := s.returnParam(req); param != "" {
+		query.Set("return", param)
+	}
+	path := "/"
+	if !s.foreignHost(req) {
+		path = req.URL.Path
+	}
+
+	langs := []Language{}
+	for _, lang := range catalog.Languages() {
+		query.Set("lang", lang)
+		langs = append(langs, Language{
+			Code:    lang,
+			Name:    catalog.Translate(lang, "language"),
+			URL:     path + "?" + query.Encode(),
+			Current: lang == current,
+		})
+	}
+	return langs
+}
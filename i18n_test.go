@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCatalog(t *testing.T) {
+	c, err := loadCatalog("example/locales")
+	if err != nil {
+		t.Fatalf("example locales failed: %v", err)
+	}
+
+	cases := []struct {
+		accept string
+		lang   string
+	}{
+		{"", "en"},
+		{"de", "de"},
+		{"de-AT,de;q=0.9,en;q=0.8", "de"},
+		{"fr, es;q=0.5, en;q=0.7", "en"},
+		{"fr, es;q=0.5", "es"},
+		{"*", "en"},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Language", tc.accept)
+		if lang := c.Negotiate(req); lang != tc.lang {
+			t.Errorf("%q negotiated %s, expected %s", tc.accept, lang, tc.lang)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/?lang=es", nil)
+	req.Header.Set("Accept-Language", "de")
+	if lang := c.Negotiate(req); lang != "es" {
+		t.Errorf("lang parameter negotiated %s", lang)
+	}
+
+	if msg := c.Translate("de", "too_many_attempts", "5s"); msg != "zu viele Versuche, bitte in 5s erneut versuchen" {
+		t.Errorf("unexpected translation %q", msg)
+	}
+	if msg := c.Translate("xx", "unauthorized"); msg != "unauthorized" {
+		t.Errorf("unexpected fallback %q", msg)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// idleInterval is how often device traffic is checked for idle timeouts
+const idleInterval = time.Minute
+
+// activity is the last change seen in a device's traffic
+type activity struct {
+	packets uint64
+	seen    time.Time
+}
+
+// RunIdleCheck removes devices which have sent no traffic
+// for their token's idle timeout
+func (s *Server) RunIdleCheck() {
+	counters, ok := s.backend.(DeviceCounters)
+	if !ok {
+		return
+	}
+
+	seen := map[string]activity{}
+	for range time.Tick(idleInterval) {
+		stats, err := counters.DeviceCounters()
+		if err != nil {
+			log.Printf("failed reading device counters: %v", err)
+			continue
+		}
+		s.checkIdle(time.Now(), stats, seen)
+	}
+}
+
+// checkIdle revokes devices whose packet count hasn't changed
+// within their token's idle timeout
+// Devices without a counter, or suspended by a schedule, are skipped
+func (s *Server) checkIdle(now time.Time, stats map[string]Counter, seen map[string]activity) {
+	current := map[string]activity{}
+	for _, session := range s.sessions.Sessions() {
+		hw, err := net.ParseMAC(session.HardwareAddr)
+		if err != nil {
+			continue
+		}
+		token, ok := s.TokenNamed(session.Token)
+		if !ok || token.idleTimeout == 0 || s.Suspended(hw) {
+			continue
+		}
+		stat, ok := stats[hw.String()]
+		if !ok {
+			continue
+		}
+
+		last, ok := seen[hw.String()]
+		if !ok || last.packets != stat.Packets {
+			last = activity{packets: stat.Packets, seen: now}
+		}
+		if now.Sub(last.seen) >= token.idleTimeout {
+			if err := s.Revoke(hw, "idle"); err != nil {
+				log.Printf("failed removing idle device %s: %v", hw, err)
+			}
+			continue
+		}
+		current[hw.String()] = last
+	}
+
+	// Forget devices which are gone
+	for hw := range seen {
+		delete(seen, hw)
+	}
+	for hw, a := range current {
+		seen[hw] = a
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckIdle(t *testing.T) {
+	ss, err := NewSessionStore(filepath.Join(t.TempDir(), "sessions.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		backend:   NewMemBackend(),
+		sessions:  ss,
+		timers:    map[string]*time.Timer{},
+		suspended: map[string]bool{},
+	}
+	idle := Token{Name: "open", IdleTimeout: "15m"}
+	if err := idle.parse(); err != nil {
+		t.Fatal(err)
+	}
+	s.tokens = []Token{idle, {Name: "staff"}}
+
+	busy, _ := net.ParseMAC("00:00:00:00:00:01")
+	quiet, _ := net.ParseMAC("00:00:00:00:00:02")
+	staff, _ := net.ParseMAC("00:00:00:00:00:03")
+	for _, session := range []Session{
+		{HardwareAddr: busy.String(), Token: "open"},
+		{HardwareAddr: quiet.String(), Token: "open"},
+		{HardwareAddr: staff.String(), Token: "staff"},
+	} {
+		ss.Add(session)
+	}
+
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	seen := map[string]activity{}
+	cases := []struct {
+		after    time.Duration
+		busy     uint64
+		quiet    uint64
+		quietEnd bool
+	}{
+		{0, 10, 5, false},
+		{10 * time.Minute, 20, 5, false},
+		{15 * time.Minute, 30, 5, true},
+	}
+	for _, c := range cases {
+		stats := map[string]Counter{
+			busy.String():  {Packets: c.busy},
+			quiet.String(): {Packets: c.quiet},
+			staff.String(): {Packets: 1},
+		}
+		s.checkIdle(now.Add(c.after), stats, seen)
+
+		if _, ok := ss.Session(busy); !ok {
+			t.Errorf("busy device removed after %s", c.after)
+		}
+		if _, ok := ss.Session(staff); !ok {
+			t.Errorf("device without idle timeout removed after %s", c.after)
+		}
+		if _, ok := ss.Session(quiet); ok == c.quietEnd {
+			t.Errorf("quiet device session present %v after %s", ok, c.after)
+		}
+	}
+	if _, ok := seen[quiet.String()]; ok {
+		t.Error("removed device still tracked")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// In ipset mode, authorized devices are kept in hash:mac sets, so the
+// captive_allowed and access chains hold a single rule each and adding
+// or removing a device doesn't touch iptables at all
+
+// allowedSet returns the name of the set of authorized devices
+// Each IP version has its own, so either backend can destroy it on close
+func (b *IPTablesBackend) allowedSet() string {
+	if b.config.ipv6 {
+		return "stargate_allowed6"
+	}
+	return "stargate_allowed"
+}
+
+// networkSet returns the name of the set of devices allowed into a network
+func networkSet(network string) string {
+	return "stargate_net_" + network
+}
+
+// matchSet returns a rule accepting devices in a set
+func matchSet(set string) []string {
+	return []string{"-m", "set", "--match-set", set, "src", "-j", "ACCEPT"}
+}
+
+// ipset runs commands through ipset restore in a single invocation
+func ipset(commands ...string) error {
+	cmd := exec.Command("ipset", "-exist", "restore")
+	cmd.Stdin = strings.NewReader(strings.Join(commands, "\n") + "\n")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ipset: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// addDeviceToSets adds a device to the allowed set and its networks' sets
+// If any add fails, the device is removed again from the sets
+// it wasn't in before, e.g. when a device is regranted
+func (b *IPTablesBackend) addDeviceToSets(networks []string, device Device) error {
+	sets := []string{b.allowedSet()}
+	for _, n := range networks {
+		sets = append(sets, networkSet(n))
+	}
+
+	added := []string{}
+	adds := []string{}
+	for _, set := range sets {
+		if setContains(set, device.HardwareAddr) {
+			continue
+		}
+		added = append(added, set)
+		adds = append(adds, fmt.Sprintf("add %s %s", set, device.HardwareAddr))
+	}
+	if len(adds) == 0 {
+		return nil
+	}
+	if err := ipset(adds...); err != nil {
+		b.removeDeviceFromSets(added, device)
+		return err
+	}
+	return nil
+}
+
+// setContains checks if a device is in a set
+func setContains(set string, hw net.HardwareAddr) bool {
+	return exec.Command("ipset", "-quiet", "test", set, hw.String()).Run() == nil
+}
+
+// removeDeviceFromSets removes a device from the named sets
+func (b *IPTablesBackend) removeDeviceFromSets(sets []string, device Device) error {
+	dels := []string{}
+	for _, set := range sets {
+		dels = append(dels, fmt.Sprintf("del %s %s", set, device.HardwareAddr))
+	}
+	return ipset(dels...)
+}
+
+// deviceSets returns every set a device may be a member of
+func (b *IPTablesBackend) deviceSets() []string {
+	sets := []string{b.allowedSet()}
+	for _, n := range b.Networks() {
+		sets = append(sets, networkSet(n.Name))
+	}
+	return sets
+}
+
+// tmpSet is the name of the set swapped in for an outdated set
+const tmpSet = "stargate_tmp"
+
+// createSet creates an empty hash:mac set
+// Each entry counts the traffic it matches
+// A set left by a previous run is flushed, so devices which were
+// revoked or expired while stargate was down don't keep access
+// A set left with another definition, e.g. without counters, is swapped
+// for a new one, since rules may still refer to it
+func createSet(set string) error {
+	create := "create %s hash:mac counters"
+	if err := ipset(fmt.Sprintf(create, set), "flush "+set); err == nil {
+		return nil
+	}
+	debugf("recreating ipset %s with a new definition", set)
+	return ipset(fmt.Sprintf(create, tmpSet), "flush "+tmpSet,
+		fmt.Sprintf("swap %s %s", tmpSet, set), "destroy "+tmpSet)
+}
+
+// setCounters returns the counters of each entry in a set
+func setCounters(set string) (map[string]Counter, error) {
+	out, err := exec.Command("ipset", "save", set).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ipset: %v", err)
+	}
+	return parseSetCounters(string(out)), nil
+}
+
+// parseSetCounters parses the entry counters of ipset save output,
+// where entries look like "add <set> <mac> packets <n> bytes <n>"
+func parseSetCounters(out string) map[string]Counter {
+	counters := map[string]Counter{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "add" {
+			continue
+		}
+		hw, err := net.ParseMAC(fields[2])
+		if err != nil {
+			continue
+		}
+		c := Counter{}
+		for i := 3; i+1 < len(fields); i += 2 {
+			n, _ := strconv.ParseUint(fields[i+1], 10, 64)
+			switch fields[i] {
+			case "packets":
+				c.Packets = n
+			case "bytes":
+				c.Bytes = n
+			}
+		}
+		counters[hw.String()] = c
+	}
+	return counters
+}
+
+// destroySet destroys a set, which must not be referenced by any rule
+func destroySet(set string) error {
+	return ipset(fmt.Sprintf("destroy %s", set))
+}
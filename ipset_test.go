@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestParseSetCounters(t *testing.T) {
+	out := `create stargate_allowed hash:mac hashsize 1024 maxelem 65536 counters
+add stargate_allowed 00:11:22:33:44:55 packets 12 bytes 3456
+add stargate_allowed AA:BB:CC:DD:EE:FF packets 0 bytes 0
+add stargate_allowed not-a-mac packets 1 bytes 1
+`
+	counters := parseSetCounters(out)
+	if len(counters) != 2 {
+		t.Fatalf("expected 2 counters, got %v", counters)
+	}
+	if c := counters["00:11:22:33:44:55"]; c.Packets != 12 || c.Bytes != 3456 {
+		t.Errorf("unexpected counter %+v", c)
+	}
+	if c, ok := counters["aa:bb:cc:dd:ee:ff"]; !ok || c.Packets != 0 {
+		t.Errorf("unexpected counter %+v", c)
+	}
+}
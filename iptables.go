@@ -3,7 +3,10 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"log"
 	"net"
+	"os/exec"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -27,7 +30,13 @@ func (b *IPTablesBackend) chains() []chain {
 	for _, port := range b.config.ports.UDP {
 		rules = append(rules, fmt.Sprintf("-p %s --dport %d -j RETURN", "udp", port))
 	}
-	return []chain{
+	rules = append(rules, fmt.Sprintf("-p tcp -m multiport --dports %d,%d -j RETURN", b.config.ports.HTTP, b.config.ports.HTTPS))
+	if b.config.ipv6 {
+		// Neighbor discovery has to keep working for unauthorized devices
+		rules = append(rules, "-p ipv6-icmp -j RETURN")
+	}
+
+	chains := []chain{
 		{"captive_check", "mangle", "PREROUTING",
 			[]string{
 				"-j captive_allowed",
@@ -35,28 +44,221 @@ func (b *IPTablesBackend) chains() []chain {
 			}},
 		{"captive_redirect", "nat", "PREROUTING",
 			[]string{
-				fmt.Sprintf("-m mark --mark 99 -p tcp --dport 80 -j DNAT --to-destination %s:%d", b.config.ip, b.config.ports.HTTP),
-				fmt.Sprintf("-m mark --mark 99 -p tcp --dport 443 -j DNAT --to-destination %s:%d", b.config.ip, b.config.ports.HTTPS),
-			}},
-		{"captive_return", "nat", "POSTROUTING",
-			[]string{
-				fmt.Sprintf("-d $NET -p tcp --sport %d -j SNAT --to-source :80", b.config.ports.HTTP),
-				fmt.Sprintf("-d $NET -p tcp --sport %d -j SNAT --to-source :443", b.config.ports.HTTPS),
+				fmt.Sprintf("-m mark --mark 99 -p tcp --dport 80 -j DNAT --to-destination %s", b.destination(b.config.ports.HTTP)),
+				fmt.Sprintf("-m mark --mark 99 -p tcp --dport 443 -j DNAT --to-destination %s", b.destination(b.config.ports.HTTPS)),
 			}},
 		{"captive_input", "filter", "INPUT",
-			append(rules, []string{
-				fmt.Sprintf("-p tcp -m multiport --dports %d,%d -j RETURN", b.config.ports.HTTP, b.config.ports.HTTPS),
-				"-j REJECT",
-			}...)},
+			append(rules, "-j REJECT")},
 		{"captive_forward", "filter", "FORWARD",
 			[]string{
 				"-p udp --dport 53 -j RETURN",
 				"-m mark --mark 99 -j REJECT",
 			}},
 	}
+	if !b.config.ipv6 {
+		chains = append(chains, chain{"captive_return", "nat", "POSTROUTING",
+			[]string{
+				fmt.Sprintf("-d %s -p tcp --sport %d -j SNAT --to-source :80", b.config.net, b.config.ports.HTTP),
+				fmt.Sprintf("-d %s -p tcp --sport %d -j SNAT --to-source :443", b.config.net, b.config.ports.HTTPS),
+			}})
+	}
+	return chains
+}
+
+// destination returns the DNAT destination for a port on the listen address
+func (b *IPTablesBackend) destination(port int) string {
+	if b.config.ipv6 {
+		return fmt.Sprintf("[%s]:%d", b.config.ip, port)
+	}
+	return fmt.Sprintf("%s:%d", b.config.ip, port)
+}
+
+// networkRules returns the FORWARD rules which send traffic for a network
+// through its access chain
+func (b *IPTablesBackend) networkRules(network Network) [][]string {
+	return [][]string{
+		{"-s", b.config.net, "-d", network.String(), "-j", "access_" + network.Name},
+		{"-s", b.config.net, "-d", network.String(), "-j", "DROP"},
+	}
+}
+
+var restoreTables = []string{"mangle", "nat", "filter"}
+
+// restore builds an iptables-restore or ip6tables-restore payload
+type restore struct {
+	command string
+	lines   map[string][]string
+}
+
+func (b *IPTablesBackend) newRestore() *restore {
+	command := "iptables-restore"
+	if b.config.ipv6 {
+		command = "ip6tables-restore"
+	}
+	return &restore{command: command, lines: map[string][]string{}}
+}
+
+// add appends a line to a table's section of the payload
+func (r *restore) add(table string, line ...string) {
+	r.lines[table] = append(r.lines[table], strings.Join(line, " "))
+}
+
+// appendUnique adds a rule to the payload unless it already exists
+func (r *restore) appendUnique(t *tables, table, chain string, rulespec ...string) {
+	if !t.hasRule(table, chain, rulespec...) {
+		r.add(table, append([]string{"-A", chain}, rulespec...)...)
+	}
+}
+
+// deleteExisting adds the deletion of a rule to the payload if it exists
+func (r *restore) deleteExisting(t *tables, table, chain string, rulespec ...string) {
+	if t.hasRule(table, chain, rulespec...) {
+		r.add(table, append([]string{"-D", chain}, rulespec...)...)
+	}
+}
+
+// section renders a table's part of the payload
+func (r *restore) section(table string) string {
+	var s bytes.Buffer
+	fmt.Fprintf(&s, "*%s\n", table)
+	for _, line := range r.lines[table] {
+		s.WriteString(line + "\n")
+	}
+	s.WriteString("COMMIT\n")
+	return s.String()
+}
+
+// apply runs the payload through iptables-restore without flushing
+// unrelated rules
+// iptables-restore only commits a table at a time, so the tables are
+// applied one by one, and if one fails, the tables already changed
+// are restored from the snapshot taken before building the payload
+// Changes made by others since the snapshot are lost in that case
+func (r *restore) apply(before *tables) error {
+	applied := []string{}
+	for _, table := range restoreTables {
+		if len(r.lines[table]) == 0 {
+			continue
+		}
+		if err := r.run(r.section(table), "--noflush"); err != nil {
+			for i := len(applied) - 1; i >= 0; i-- {
+				if rerr := r.run(before.section(applied[i]), "--counters"); rerr != nil {
+					log.Printf("failed rolling back the %s table: %v", applied[i], rerr)
+				}
+			}
+			return err
+		}
+		applied = append(applied, table)
+	}
+	return nil
+}
+
+// run feeds a payload to iptables-restore
+func (r *restore) run(payload string, args ...string) error {
+	cmd := exec.Command(r.command, args...)
+	cmd.Stdin = strings.NewReader(payload)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", r.command, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// tables is a snapshot of the chains and rules of each table
+type tables struct {
+	sections map[string]string
+	chains   map[string]map[string]bool
+	rules    map[string]map[string]bool
+}
+
+// saveTables takes a snapshot of the tables with a single iptables-save
+func (b *IPTablesBackend) saveTables() (*tables, error) {
+	command := "iptables-save"
+	if b.config.ipv6 {
+		command = "ip6tables-save"
+	}
+	out, err := exec.Command(command, "--counters").Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", command, err)
+	}
+	return parseSave(string(out)), nil
+}
+
+// parseSave reads the output of iptables-save --counters
+func parseSave(out string) *tables {
+	t := &tables{
+		sections: map[string]string{},
+		chains:   map[string]map[string]bool{},
+		rules:    map[string]map[string]bool{},
+	}
+	table := ""
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "*") {
+			table = line[1:]
+			t.chains[table] = map[string]bool{}
+			t.rules[table] = map[string]bool{}
+		}
+		if table == "" {
+			continue
+		}
+		t.sections[table] += line + "\n"
+
+		fields := strings.Fields(line)
+		if strings.HasPrefix(fields[0], "[") {
+			fields = fields[1:]
+		}
+		switch {
+		case strings.HasPrefix(line, ":"):
+			t.chains[table][fields[0][1:]] = true
+		case len(fields) > 1 && fields[0] == "-A":
+			t.rules[table][ruleKey(fields[1], fields[2:])] = true
+		case line == "COMMIT":
+			table = ""
+		}
+	}
+	return t
+}
+
+// hasChain checks if a chain exists in the snapshot
+func (t *tables) hasChain(table, chain string) bool {
+	return t.chains[table][chain]
+}
+
+// hasRule checks if a rule exists in the snapshot
+func (t *tables) hasRule(table, chain string, rulespec ...string) bool {
+	return t.rules[table][ruleKey(chain, rulespec)]
 }
 
-// IPTablesBackend represents a portal backend supporting iptables
+// section returns a table as it was in the snapshot,
+// or an empty table if it wasn't loaded then
+func (t *tables) section(table string) string {
+	if section, ok := t.sections[table]; ok {
+		return section
+	}
+	return fmt.Sprintf("*%s\nCOMMIT\n", table)
+}
+
+// ruleKey renders a rule the way iptables-save lists it,
+// which leaves out matches on any address
+func ruleKey(chain string, rulespec []string) string {
+	key := []string{chain}
+	for i := 0; i < len(rulespec); i++ {
+		if (rulespec[i] == "-s" || rulespec[i] == "-d") && i+1 < len(rulespec) &&
+			(rulespec[i+1] == "0.0.0.0/0" || rulespec[i+1] == "::/0") {
+			i++
+			continue
+		}
+		key = append(key, rulespec[i])
+	}
+	return strings.Join(key, " ")
+}
+
+// IPTablesBackend represents a portal backend supporting iptables,
+// or ip6tables for an IPv6 listen address
 type IPTablesBackend struct {
 	ipt      *iptables.IPTables
 	config   BackendConfig
@@ -68,7 +270,11 @@ type IPTablesBackend struct {
 
 // NewIPTablesBackend returns a backend provided a config
 func NewIPTablesBackend(cfg BackendConfig) Backend {
-	i, err := iptables.New()
+	proto := iptables.ProtocolIPv4
+	if cfg.ipv6 {
+		proto = iptables.ProtocolIPv6
+	}
+	i, err := iptables.NewWithProtocol(proto)
 	if err != nil {
 		panic("iptables not supported")
 	}
@@ -84,50 +290,133 @@ func NewIPTablesBackend(cfg BackendConfig) Backend {
 
 // Open will initialize iptables by defining chains
 // and inserting them into the built-in chains
-func (b *IPTablesBackend) Open() {
-	b.ipt.NewChain("mangle", "captive_allowed")
+// The ruleset is built against a single iptables-save and applied
+// with iptables-restore, see restore.apply
+func (b *IPTablesBackend) Open() error {
+	existing, err := b.saveTables()
+	if err != nil {
+		return err
+	}
+
+	r := b.newRestore()
+	r.add("mangle", ":captive_allowed", "-", "[0:0]")
+	if b.config.ipset {
+		if err := createSet(b.allowedSet()); err != nil {
+			return err
+		}
+		r.add("mangle", append([]string{"-A", "captive_allowed"}, matchSet(b.allowedSet())...)...)
+	}
 	for _, c := range b.chains() {
-		b.ipt.NewChain(c.table, c.name)
-		for _, t := range c.rules {
-			rule := strings.Split(t, " ")
-			b.ipt.AppendUnique(c.table, c.name, rule...)
+		r.add(c.table, ":"+c.name, "-", "[0:0]")
+		for _, rule := range c.rules {
+			r.add(c.table, "-A", c.name, rule)
 		}
-		b.ipt.AppendUnique(c.table, c.hook, "-s", b.config.net, "-j", c.name)
+	}
+	for _, n := range b.Networks() {
+		r.add("filter", ":access_"+n.Name, "-", "[0:0]")
+		r.add("filter", append([]string{"-A", "access_" + n.Name}, b.counterRule(n.Name)...)...)
 	}
 
-	b.ipt.AppendUnique("nat", "POSTROUTING", "-j", "MASQUERADE")
+	// Hook the chains in, unless a previous run left them hooked
+	for _, c := range b.chains() {
+		r.appendUnique(existing, c.table, c.hook, "-s", b.config.net, "-j", c.name)
+	}
+	for _, n := range b.Networks() {
+		for _, rule := range b.networkRules(n) {
+			r.appendUnique(existing, "filter", "FORWARD", rule...)
+		}
+	}
+	r.appendUnique(existing, "nat", "POSTROUTING", "-j", "MASQUERADE")
 
 	// Drop the main gate
-	b.ipt.Delete("filter", "INPUT", "-s", b.config.net, "-j", "REJECT")
-	b.ipt.Delete("filter", "FORWARD", "-s", b.config.net, "-j", "REJECT")
+	for _, hook := range []string{"INPUT", "FORWARD"} {
+		r.deleteExisting(existing, "filter", hook, b.reject()...)
+	}
 
-	debugf("opened iptables backend")
+	if err := r.apply(existing); err != nil {
+		return err
+	}
+
+	debugf("opened iptables backend for %s", b.config.net)
+	return nil
 }
 
 // Close will remove the portal chains from the built-in chains
 // and remove the chains themselves
 // Close will also insert basic rules to firewall the managed network
-func (b *IPTablesBackend) Close() {
-	b.ipt.Delete("nat", "POSTROUTING", "-j", "MASQUERADE")
+// Like Open, this is built against a single iptables-save
+func (b *IPTablesBackend) Close() error {
+	existing, err := b.saveTables()
+	if err != nil {
+		return err
+	}
 
-	for _, n := range b.networks {
-		b.RemoveNetwork(n)
+	r := b.newRestore()
+
+	// Add rules to keep the hordes at bay
+	for _, hook := range []string{"INPUT", "FORWARD"} {
+		r.appendUnique(existing, "filter", hook, b.reject()...)
 	}
+	r.deleteExisting(existing, "nat", "POSTROUTING", "-j", "MASQUERADE")
 
+	// Unhook the chains before flushing and deleting them
+	chains := []chain{}
+	for _, n := range b.Networks() {
+		for _, rule := range b.networkRules(n) {
+			r.deleteExisting(existing, "filter", "FORWARD", rule...)
+		}
+		chains = append(chains, chain{name: "access_" + n.Name, table: "filter"})
+	}
 	for _, c := range b.chains() {
-		b.ipt.Delete(c.table, c.hook, "-s", b.config.net, "-j", c.name)
-		b.ipt.ClearChain(c.table, c.name)
-		b.ipt.DeleteChain(c.table, c.name)
+		r.deleteExisting(existing, c.table, c.hook, "-s", b.config.net, "-j", c.name)
+		chains = append(chains, c)
+	}
+	chains = append(chains, chain{name: "captive_allowed", table: "mangle"})
+
+	for _, c := range chains {
+		if existing.hasChain(c.table, c.name) {
+			r.add(c.table, "-F", c.name)
+		}
+	}
+	for _, c := range chains {
+		if existing.hasChain(c.table, c.name) {
+			r.add(c.table, "-X", c.name)
+		}
+	}
+
+	if err := r.apply(existing); err != nil {
+		return err
 	}
 
-	b.ipt.ClearChain("mangle", "captive_allowed")
-	b.ipt.DeleteChain("mangle", "captive_allowed")
+	// Sets can only go once no rule refers to them
+	if b.config.ipset {
+		for _, set := range b.deviceSets() {
+			if err := destroySet(set); err != nil {
+				return err
+			}
+		}
+	}
 
-	// Add rules to keep the hordes at bay
-	b.ipt.AppendUnique("filter", "INPUT", "-s", b.config.net, "-j", "REJECT")
-	b.ipt.AppendUnique("filter", "FORWARD", "-s", b.config.net, "-j", "REJECT")
+	b.nlock.Lock()
+	b.networks = []Network{}
+	b.nlock.Unlock()
 
-	debugf("closed iptables backend")
+	b.dlock.Lock()
+	b.devices = []Device{}
+	b.dlock.Unlock()
+
+	debugf("closed iptables backend for %s", b.config.net)
+	return nil
+}
+
+// reject returns the rule rejecting the managed network,
+// with the reject type iptables-save lists it with
+func (b *IPTablesBackend) reject() []string {
+	with := "icmp-port-unreachable"
+	if b.config.ipv6 {
+		with = "icmp6-port-unreachable"
+	}
+	return []string{"-s", b.config.net, "-j", "REJECT", "--reject-with", with}
 }
 
 // HWAddrExists checks if the specified mac addr is known to the portal
@@ -142,6 +431,13 @@ func (b *IPTablesBackend) HWAddrExists(hw net.HardwareAddr) bool {
 	return false
 }
 
+// Devices fulfills the Devices interface
+func (b *IPTablesBackend) Devices() []Device {
+	b.dlock.Lock()
+	defer b.dlock.Unlock()
+	return append([]Device{}, b.devices...)
+}
+
 // Networks fulfills the ListNetworks interface
 func (b *IPTablesBackend) Networks() []Network {
 	b.nlock.Lock()
@@ -150,68 +446,224 @@ func (b *IPTablesBackend) Networks() []Network {
 }
 
 // AddNetwork fulfills the Networks interface
-func (b *IPTablesBackend) AddNetwork(network Network) {
+func (b *IPTablesBackend) AddNetwork(network Network) error {
 	b.nlock.Lock()
 	defer b.nlock.Unlock()
-	b.networks = append(b.networks, network)
 
-	b.ipt.NewChain("filter", "access_"+network.Name)
-	b.ipt.AppendUnique("filter", "FORWARD", "-s", b.config.net, "-d", network.String(), "-j", "access_"+network.Name)
-	b.ipt.AppendUnique("filter", "FORWARD", "-s", b.config.net, "-d", network.String(), "-j", "DROP")
+	if err := b.ipt.ClearChain("filter", "access_"+network.Name); err != nil {
+		return err
+	}
+	if b.config.ipset {
+		if err := createSet(networkSet(network.Name)); err != nil {
+			return err
+		}
+	}
+	if err := b.ipt.AppendUnique("filter", "access_"+network.Name, b.counterRule(network.Name)...); err != nil {
+		return err
+	}
+	rules := b.networkRules(network)
+	for i, rule := range rules {
+		if err := b.ipt.AppendUnique("filter", "FORWARD", rule...); err != nil {
+			for _, added := range rules[:i] {
+				b.ipt.Delete("filter", "FORWARD", added...)
+			}
+			b.ipt.DeleteChain("filter", "access_"+network.Name)
+			return err
+		}
+	}
+	b.networks = append(b.networks, network)
 
 	debugf("network %s added", network.Name)
+	return nil
 }
 
 // RemoveNetwork fulfills the Networks interface
-func (b *IPTablesBackend) RemoveNetwork(network Network) {
+func (b *IPTablesBackend) RemoveNetwork(network Network) error {
 	b.nlock.Lock()
 	defer b.nlock.Unlock()
 	networks := []Network{}
 	for _, n := range b.networks {
-		if n.Name == network.Name {
-			networks = append(networks, network)
+		if n.Name != network.Name {
+			networks = append(networks, n)
 		}
 	}
 	b.networks = networks
 
-	b.ipt.Delete("filter", "FORWARD", "-s", b.config.net, "-d", network.String(), "-j", "DROP")
-	b.ipt.Delete("filter", "FORWARD", "-s", b.config.net, "-d", network.String(), "-j", "access_"+network.Name)
-	b.ipt.ClearChain("filter", "access_"+network.Name)
-	b.ipt.DeleteChain("filter", "access_"+network.Name)
+	errs := []error{}
+	for _, rule := range b.networkRules(network) {
+		errs = append(errs, b.deleteIfExists("filter", "FORWARD", rule...))
+	}
+	errs = append(errs,
+		b.ipt.ClearChain("filter", "access_"+network.Name),
+		b.ipt.DeleteChain("filter", "access_"+network.Name))
+	if b.config.ipset {
+		errs = append(errs, destroySet(networkSet(network.Name)))
+	}
+	if err := firstError(errs...); err != nil {
+		return err
+	}
 
 	debugf("network %s removed", network.Name)
+	return nil
 }
 
 // AddDevice fulfills the Device interface
-func (b *IPTablesBackend) AddDevice(networks []string, device Device) {
+// Networks the backend doesn't know, e.g. removed by a reload, are skipped
+// If a rule can't be added, the rules this call added before it are removed
+func (b *IPTablesBackend) AddDevice(networks []string, device Device) error {
 	b.dlock.Lock()
 	defer b.dlock.Unlock()
-	b.devices = append(b.devices, device)
+	networks = networksOf(b, networks)
 
-	b.ipt.AppendUnique("mangle", "captive_allowed", "-m", "mac", "--mac-source", device.HardwareAddr.String(), "-j", "ACCEPT")
+	if b.config.ipset {
+		if err := b.addDeviceToSets(networks, device); err != nil {
+			return fmt.Errorf("failed adding device %s: %v", device.HardwareAddr, err)
+		}
+		b.devices = append(withoutDevice(b.devices, device), device)
+		debugf("added device %s to networks %v", device.HardwareAddr.String(), networks)
+		return nil
+	}
+
+	mac := []string{"-m", "mac", "--mac-source", device.HardwareAddr.String(), "-j", "ACCEPT"}
+	rules := []struct{ table, chain string }{{"mangle", "captive_allowed"}}
 	for _, n := range networks {
-		b.ipt.AppendUnique("filter", "access_"+n, "-m", "mac", "--mac-source", device.HardwareAddr.String(), "-j", "ACCEPT")
+		rules = append(rules, struct{ table, chain string }{"filter", "access_" + n})
+	}
+
+	added := []struct{ table, chain string }{}
+	for _, r := range rules {
+		exists, err := b.ipt.Exists(r.table, r.chain, mac...)
+		if err == nil && !exists {
+			err = b.ipt.Append(r.table, r.chain, mac...)
+		}
+		if err != nil {
+			for _, a := range added {
+				b.ipt.Delete(a.table, a.chain, mac...)
+			}
+			return fmt.Errorf("failed adding device %s to %s: %v", device.HardwareAddr, r.chain, err)
+		}
+		if !exists {
+			added = append(added, r)
+		}
 	}
+	b.devices = append(withoutDevice(b.devices, device), device)
 
 	debugf("added device %s to networks %v", device.HardwareAddr.String(), networks)
+	return nil
 }
 
 // RemoveDevice fulfills the Device interface
-func (b *IPTablesBackend) RemoveDevice(device Device) {
+func (b *IPTablesBackend) RemoveDevice(device Device) error {
 	b.dlock.Lock()
 	defer b.dlock.Unlock()
-	devices := []Device{}
-	for _, d := range b.devices {
-		if d.Name != device.Name {
-			devices = append(devices, device)
+
+	if b.config.ipset {
+		if err := b.removeDeviceFromSets(b.deviceSets(), device); err != nil {
+			return err
+		}
+	} else {
+		mac := []string{"-m", "mac", "--mac-source", device.HardwareAddr.String(), "-j", "ACCEPT"}
+		errs := []error{b.deleteIfExists("mangle", "captive_allowed", mac...)}
+		for _, n := range b.Networks() {
+			errs = append(errs, b.deleteIfExists("filter", "access_"+n.Name, mac...))
+		}
+		if err := firstError(errs...); err != nil {
+			return err
 		}
 	}
-	b.devices = devices
+	b.devices = withoutDevice(b.devices, device)
 
-	b.ipt.Delete("mangle", "captive_allowed", "-m", "mac", "--mac-source", device.HardwareAddr.String(), "-j", "ACCEPT")
-	for _, n := range b.networks {
-		b.ipt.Delete("filter", "access_"+n.Name, "-m", "mac", "--mac-source", device.HardwareAddr.String(), "-j", "ACCEPT")
+	debugf("removed device %s", device.HardwareAddr.String())
+	return nil
+}
+
+// deleteIfExists deletes a rule, ignoring rules which don't exist
+func (b *IPTablesBackend) deleteIfExists(table, chain string, rulespec ...string) error {
+	exists, err := b.ipt.Exists(table, chain, rulespec...)
+	if err != nil || !exists {
+		return err
 	}
+	return b.ipt.Delete(table, chain, rulespec...)
+}
 
-	debugf("removed device %s", device.HardwareAddr.String())
+// NetworkCounters fulfills the Counters interface by reading
+// the counters of each network's counter rule
+func (b *IPTablesBackend) NetworkCounters() (map[string]Counter, error) {
+	counters := map[string]Counter{}
+	for _, n := range b.Networks() {
+		rules, err := b.ipt.ListWithCounters("filter", "access_"+n.Name)
+		if err != nil {
+			return nil, err
+		}
+		counters[n.Name] = headCounter(rules)
+	}
+	return counters, nil
+}
+
+// counterRule returns the rule at the head of a network's access chain
+// counting its traffic: the set match in ipset mode, or else a rule
+// without a target, as device rules take their counters with them
+func (b *IPTablesBackend) counterRule(network string) []string {
+	if b.config.ipset {
+		return matchSet(networkSet(network))
+	}
+	return []string{"-m", "comment", "--comment", "stargate_counter"}
+}
+
+// headCounter returns the counters of the first rule in an iptables -v -S
+// listing, which holds them as "-c <packets> <bytes>"
+func headCounter(rules []string) Counter {
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+		if len(fields) == 0 || fields[0] != "-A" {
+			continue
+		}
+		for i, field := range fields {
+			if field == "-c" && i+2 < len(fields) {
+				packets, _ := strconv.ParseUint(fields[i+1], 10, 64)
+				bytes, _ := strconv.ParseUint(fields[i+2], 10, 64)
+				return Counter{Packets: packets, Bytes: bytes}
+			}
+		}
+		break
+	}
+	return Counter{}
+}
+
+// DeviceCounters fulfills the DeviceCounters interface by reading
+// the counters of each device's captive_allowed rule,
+// or of its entry in the allowed set in ipset mode
+func (b *IPTablesBackend) DeviceCounters() (map[string]Counter, error) {
+	if b.config.ipset {
+		return setCounters(b.allowedSet())
+	}
+
+	stats, err := b.ipt.Stats("mangle", "captive_allowed")
+	if err != nil {
+		return nil, err
+	}
+	return macCounters(stats), nil
+}
+
+// macCounters returns the counters of rules matching a mac addr,
+// from iptables stats whose last field holds the rule's options,
+// like "MAC 00:11:22:33:44:55"
+func macCounters(stats [][]string) map[string]Counter {
+	counters := map[string]Counter{}
+	for _, stat := range stats {
+		options := strings.Fields(stat[len(stat)-1])
+		for i, option := range options {
+			if option != "MAC" || i+1 == len(options) {
+				continue
+			}
+			hw, err := net.ParseMAC(options[i+1])
+			if err != nil {
+				continue
+			}
+			packets, _ := strconv.ParseUint(stat[0], 10, 64)
+			bytes, _ := strconv.ParseUint(stat[1], 10, 64)
+			counters[hw.String()] = Counter{Packets: packets, Bytes: bytes}
+		}
+	}
+	return counters
 }
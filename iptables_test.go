@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestMACCounters(t *testing.T) {
+	stats := [][]string{
+		{"7", "840", "ACCEPT", "all", "--", "*", "*", "0.0.0.0/0", "0.0.0.0/0", "MAC 00:11:22:33:44:55"},
+		{"0", "0", "ACCEPT", "all", "--", "*", "*", "0.0.0.0/0", "0.0.0.0/0", "MAC AA:BB:CC:DD:EE:FF"},
+		{"3", "120", "ACCEPT", "all", "--", "*", "*", "0.0.0.0/0", "0.0.0.0/0", "match-set stargate_allowed src"},
+		{"1", "60", "ACCEPT", "all", "--", "*", "*", "0.0.0.0/0", "0.0.0.0/0", "MAC"},
+	}
+	counters := macCounters(stats)
+	if len(counters) != 2 {
+		t.Fatalf("expected 2 counters, got %v", counters)
+	}
+	if c := counters["00:11:22:33:44:55"]; c.Packets != 7 || c.Bytes != 840 {
+		t.Errorf("unexpected counter %+v", c)
+	}
+	if _, ok := counters["aa:bb:cc:dd:ee:ff"]; !ok {
+		t.Error("missing counter of idle device")
+	}
+}
+
+func TestHeadCounter(t *testing.T) {
+	rules := []string{
+		"-N access_internet",
+		"-A access_internet -m comment --comment stargate_counter -c 12 3400",
+		"-A access_internet -m mac --mac-source 00:11:22:33:44:55 -c 7 840 -j ACCEPT",
+	}
+	if c := headCounter(rules); c.Packets != 12 || c.Bytes != 3400 {
+		t.Errorf("unexpected counter %+v", c)
+	}
+	legacy := []string{"-N access_internet", "-A access_internet -c 5 300 -m set --match-set stargate_net_internet src -j ACCEPT"}
+	if c := headCounter(legacy); c.Packets != 5 || c.Bytes != 300 {
+		t.Errorf("unexpected counter %+v", c)
+	}
+	if c := headCounter([]string{"-N access_internet"}); c != (Counter{}) {
+		t.Errorf("empty chain has counter %+v", c)
+	}
+}
+
+func TestParseSave(t *testing.T) {
+	out := `# Generated by iptables-save v1.8.9 on Sat Oct 17 12:00:00 2026
+*nat
+:PREROUTING ACCEPT [10:600]
+:POSTROUTING ACCEPT [3:180]
+:captive_redirect - [0:0]
+[4:240] -A PREROUTING -s 10.0.0.0/24 -j captive_redirect
+[3:180] -A POSTROUTING -j MASQUERADE
+COMMIT
+# Completed on Sat Oct 17 12:00:00 2026
+*filter
+:INPUT ACCEPT [0:0]
+:FORWARD ACCEPT [0:0]
+:access_internet - [0:0]
+[0:0] -A INPUT -s 10.0.0.0/24 -j REJECT --reject-with icmp-port-unreachable
+[2:120] -A FORWARD -s 10.0.0.0/24 -j access_internet
+[0:0] -A access_internet -m comment --comment "managed by someone else"
+COMMIT
+`
+	tables := parseSave(out)
+
+	b := &IPTablesBackend{}
+	b.config.net = "10.0.0.0/24"
+	internet := Network{Name: "internet", IPNet: net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}}
+
+	if !tables.hasChain("nat", "captive_redirect") || !tables.hasChain("filter", "FORWARD") {
+		t.Error("missing chains")
+	}
+	if tables.hasChain("nat", "access_internet") || tables.hasChain("mangle", "captive_allowed") {
+		t.Error("chain found in the wrong table")
+	}
+	rules := []struct {
+		table, chain string
+		rulespec     []string
+		exists       bool
+	}{
+		{"nat", "PREROUTING", []string{"-s", "10.0.0.0/24", "-j", "captive_redirect"}, true},
+		{"nat", "POSTROUTING", []string{"-j", "MASQUERADE"}, true},
+		{"filter", "INPUT", b.reject(), true},
+		{"filter", "FORWARD", b.reject(), false},
+		{"filter", "FORWARD", b.networkRules(internet)[0], true},
+		{"filter", "FORWARD", b.networkRules(internet)[1], false},
+		{"filter", "PREROUTING", []string{"-s", "10.0.0.0/24", "-j", "captive_redirect"}, false},
+	}
+	for _, r := range rules {
+		if tables.hasRule(r.table, r.chain, r.rulespec...) != r.exists {
+			t.Errorf("%s %s %v exists: expected %v", r.table, r.chain, r.rulespec, r.exists)
+		}
+	}
+
+	if s := tables.section("nat"); !strings.HasPrefix(s, "*nat\n:PREROUTING ACCEPT [10:600]\n") || !strings.HasSuffix(s, "[3:180] -A POSTROUTING -j MASQUERADE\nCOMMIT\n") {
+		t.Errorf("unexpected nat section\n%s", s)
+	}
+	if s := tables.section("mangle"); s != "*mangle\nCOMMIT\n" {
+		t.Errorf("unexpected section for a table which wasn't loaded\n%s", s)
+	}
+}
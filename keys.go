@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Keys may be stored in the config as bcrypt or argon2id hashes,
+// recognized by their prefixes, or as plaintext
+
+// argon2id parameters for new hashes
+const (
+	argonTime    = 2
+	argonMemory  = 19 * 1024
+	argonThreads = 1
+	argonKeyLen  = 32
+	argonSaltLen = 16
+)
+
+type argonHash struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// isBcrypt checks for the prefixes of bcrypt hashes
+func isBcrypt(stored string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(stored, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isArgon2id checks for the prefix of argon2id hashes
+func isArgon2id(stored string) bool {
+	return strings.HasPrefix(stored, "$argon2id$")
+}
+
+// parseArgon2id parses a hash in the PHC string format
+// $argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>
+func parseArgon2id(stored string) (h argonHash, err error) {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 {
+		return h, errors.New("malformed argon2id hash")
+	}
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return h, err
+	}
+	if version != argon2.Version {
+		return h, fmt.Errorf("unsupported argon2id version %d", version)
+	}
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return h, err
+	}
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return h, err
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return h, err
+	}
+	return h, nil
+}
+
+// validateKey checks that a hashed key can be parsed
+func validateKey(stored string) error {
+	switch {
+	case isBcrypt(stored):
+		_, err := bcrypt.Cost([]byte(stored))
+		return err
+	case isArgon2id(stored):
+		_, err := parseArgon2id(stored)
+		return err
+	}
+	return nil
+}
+
+// matchKey compares a submitted key with a stored key or hash
+// in constant time
+func matchKey(stored, key string) bool {
+	switch {
+	case isBcrypt(stored):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(key)) == nil
+	case isArgon2id(stored):
+		h, err := parseArgon2id(stored)
+		if err != nil {
+			return false
+		}
+		k := argon2.IDKey([]byte(key), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+		return subtle.ConstantTimeCompare(k, h.key) == 1
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(key)) == 1
+}
+
+// hashKey returns an argon2id hash of a key
+func hashKey(key string) (string, error) {
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	k := argon2.IDKey([]byte(key), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(k)), nil
+}
+
+// hashKeyCommand reads a key from stdin and prints its hash
+// for pasting into a token's keys
+func hashKeyCommand(args []string) error {
+	fs := flag.NewFlagSet("hash-key", flag.ExitOnError)
+	useBcrypt := fs.Bool("bcrypt", false, "hash with bcrypt instead of argon2id")
+	fs.Parse(args)
+
+	fmt.Fprint(os.Stderr, "key: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	key := strings.TrimRight(line, "\r\n")
+	if key == "" {
+		return errors.New("no key given")
+	}
+
+	var hash string
+	if *useBcrypt {
+		b, err := bcrypt.GenerateFromPassword([]byte(key), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		hash = string(b)
+	} else {
+		hash, err = hashKey(key)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Println(hash)
+	return nil
+}
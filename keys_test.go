@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestMatchKey(t *testing.T) {
+	argon, err := hashKey("secopspass")
+	if err != nil {
+		t.Fatalf("hash failed: %v", err)
+	}
+	bcrypt := "$2y$10$EXfUCwUI2X7T8GAuJNc5VefrY8wL5.WnGavYtfZI2Drnv/UisWhUW"
+
+	for _, stored := range []string{argon, bcrypt, "janitor"} {
+		if err := validateKey(stored); err != nil {
+			t.Errorf("%s failed validation: %v", stored, err)
+		}
+		if matchKey(stored, "wrong") {
+			t.Errorf("%s matched the wrong key", stored)
+		}
+	}
+	if !matchKey(argon, "secopspass") {
+		t.Error("argon2id hash didn't match")
+	}
+	if !matchKey(bcrypt, "janitor") {
+		t.Error("bcrypt hash didn't match")
+	}
+	if !matchKey("janitor", "janitor") {
+		t.Error("plaintext key didn't match")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limiter slows down key guessing by making clients wait after
+// a failed login, twice as long with each failure in a row
+// If enough logins fail across all clients within the lockout window,
+// every client is locked out for the lockout duration
+// A client makes one attempt at a time, so parallel logins can't
+// skip the backoff or pile up key hashing
+type Limiter struct {
+	config   LimiterConfig
+	clients  map[string]*backoff
+	failures []time.Time
+	locked   time.Time
+	now      func() time.Time
+	lock     sync.Mutex
+}
+
+type backoff struct {
+	failures int
+	until    time.Time
+	pending  bool
+}
+
+// NewLimiter returns a limiter with the provided config
+func NewLimiter(c LimiterConfig) *Limiter {
+	return &Limiter{
+		config:  c,
+		clients: map[string]*backoff{},
+		now:     time.Now,
+	}
+}
+
+// Configure swaps in a new config, keeping the current backoffs
+func (l *Limiter) Configure(c LimiterConfig) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.config = c
+}
+
+// Attempt reserves a login attempt for the clients
+// If they must wait, the wait is returned and the attempt is blocked,
+// otherwise done must be called with the outcome of the attempt
+// A client with an attempt in progress waits for the initial backoff
+func (l *Limiter) Attempt(clients ...string) (wait time.Duration, done func(ok bool)) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	l.prune(now)
+
+	until := l.locked
+	for _, c := range clients {
+		b, ok := l.clients[c]
+		if !ok {
+			continue
+		}
+		if b.until.After(until) {
+			until = b.until
+		}
+		if b.pending && now.Add(l.config.backoff).After(until) {
+			until = now.Add(l.config.backoff)
+		}
+	}
+	if until.After(now) {
+		return until.Sub(now), nil
+	}
+
+	for _, c := range clients {
+		b, ok := l.clients[c]
+		if !ok {
+			b = &backoff{}
+			l.clients[c] = b
+		}
+		b.pending = true
+	}
+	return 0, func(ok bool) { l.done(ok, clients) }
+}
+
+// done ends the attempt of the clients, forgetting their failures
+// after a successful login, or backing them off after a failed one
+// Backoffs and lockouts are logged and counted as they begin,
+// not for each attempt they block
+func (l *Limiter) done(ok bool, clients []string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+
+	longest := time.Duration(0)
+	for _, c := range clients {
+		b, found := l.clients[c]
+		if !found {
+			continue
+		}
+		if ok {
+			delete(l.clients, c)
+			continue
+		}
+		b.pending = false
+		b.failures++
+		wait := l.config.backoff
+		for i := 1; i < b.failures && wait < l.config.maxBackoff; i++ {
+			wait *= 2
+		}
+		if wait > l.config.maxBackoff {
+			wait = l.config.maxBackoff
+		}
+		b.until = now.Add(wait)
+		if wait > longest {
+			longest = wait
+		}
+	}
+	if longest > 0 {
+		loginLockouts.WithLabelValues("client").Inc()
+		log.Printf("login from %s backed off for %s", strings.Join(clients, ", "), roundUp(longest))
+	}
+
+	if ok || l.config.lockout == 0 {
+		return
+	}
+	l.failures = append(l.failures, now)
+	if len(l.failures) >= l.config.lockout && now.After(l.locked) {
+		l.locked = now.Add(l.config.lockoutDuration)
+		l.failures = nil
+		loginLockouts.WithLabelValues("global").Inc()
+		log.Printf("all logins locked out for %s after %d failed attempts within %s",
+			l.config.lockoutDuration, l.config.lockout, l.config.lockoutWindow)
+	}
+}
+
+// prune forgets failures which no longer count
+// A client's failures are forgotten once it has waited out
+// the longest backoff since its last failure
+func (l *Limiter) prune(now time.Time) {
+	for c, b := range l.clients {
+		if !b.pending && now.Sub(b.until) > l.config.maxBackoff {
+			delete(l.clients, c)
+		}
+	}
+
+	recent := []time.Time{}
+	for _, t := range l.failures {
+		if now.Sub(t) < l.config.lockoutWindow {
+			recent = append(recent, t)
+		}
+	}
+	l.failures = recent
+}
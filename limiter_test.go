@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLimiterBackoff(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	l := NewLimiter(LimiterConfig{backoff: time.Second, maxBackoff: 4 * time.Second})
+	l.now = func() time.Time { return now }
+
+	// Failures back off 1s, 2s, 4s, then stay at the max
+	for _, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		wait, done := l.Attempt("mac a")
+		if wait > 0 {
+			t.Fatalf("attempt blocked for %s", wait)
+		}
+		done(false)
+		if wait, _ := l.Attempt("mac a"); wait != expected {
+			t.Errorf("waiting %s, expected %s", wait, expected)
+		}
+		if wait, done := l.Attempt("mac b"); wait != 0 {
+			t.Errorf("other client waiting %s", wait)
+		} else {
+			done(true)
+		}
+		now = now.Add(expected)
+	}
+
+	// A success forgets the failures
+	_, done := l.Attempt("mac a")
+	done(true)
+	_, done = l.Attempt("mac a")
+	done(false)
+	if wait, _ := l.Attempt("mac a"); wait != time.Second {
+		t.Errorf("waiting %s after success, expected 1s", wait)
+	}
+}
+
+func TestLimiterParallel(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	l := NewLimiter(LimiterConfig{backoff: time.Second, maxBackoff: time.Minute})
+	l.now = func() time.Time { return now }
+
+	// A second attempt while the first is in progress is blocked,
+	// by either of its clients
+	_, done := l.Attempt("mac a", "ip 1")
+	if wait, _ := l.Attempt("mac c", "ip 1"); wait != time.Second {
+		t.Errorf("parallel attempt waiting %s, expected 1s", wait)
+	}
+	done(false)
+	if wait, _ := l.Attempt("mac a"); wait != time.Second {
+		t.Errorf("waiting %s after failure, expected 1s", wait)
+	}
+}
+
+func TestLimiterLockout(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	l := NewLimiter(LimiterConfig{
+		backoff:         time.Second,
+		maxBackoff:      time.Minute,
+		lockout:         3,
+		lockoutWindow:   time.Minute,
+		lockoutDuration: 5 * time.Minute,
+	})
+	l.now = func() time.Time { return now }
+
+	for _, c := range []string{"mac a", "mac b", "mac c"} {
+		_, done := l.Attempt(c)
+		done(false)
+	}
+	if wait, _ := l.Attempt("mac d"); wait != 5*time.Minute {
+		t.Errorf("waiting %s during lockout, expected 5m", wait)
+	}
+	now = now.Add(5 * time.Minute)
+	if wait, _ := l.Attempt("mac d"); wait != 0 {
+		t.Errorf("waiting %s after lockout", wait)
+	}
+}
+
+func TestLimiterCountsBackoffs(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	l := NewLimiter(LimiterConfig{backoff: time.Second, maxBackoff: time.Minute})
+	l.now = func() time.Time { return now }
+	backoffs := loginLockouts.WithLabelValues("client")
+	before := testutil.ToFloat64(backoffs)
+
+	_, done := l.Attempt("mac a", "ip 1")
+	done(false)
+	for i := 0; i < 10; i++ {
+		if wait, _ := l.Attempt("mac a", "ip 1"); wait == 0 {
+			t.Fatal("attempt not blocked")
+		}
+	}
+	if n := testutil.ToFloat64(backoffs) - before; n != 1 {
+		t.Errorf("counted %v backoffs, expected 1", n)
+	}
+}
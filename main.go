@@ -1,17 +1,37 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"os/user"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
 	"syscall"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/soellman/pidfile"
 )
 
 func main() {
+	flag.Parse()
+	switch flag.Arg(0) {
+	case "hash-key":
+		if err := hashKeyCommand(flag.Args()[1:]); err != nil {
+			log.Fatalf("hash-key: %v", err)
+		}
+		return
+	case "vouchers":
+		if err := vouchersCommand(flag.Args()[1:]); err != nil {
+			log.Fatalf("vouchers: %v", err)
+		}
+		return
+	}
+
 	// check for linux
 	if runtime.GOOS != "linux" {
 		log.Fatalf("Sorry, only linux is supported at this time.")
@@ -33,27 +53,64 @@ func main() {
 		log.Fatalf("Runtime validation failed: %v\n", err)
 	}
 
+	// load sessions from the last run
+	sessions, err := NewSessionStore(filepath.Join(sdir, "sessions.json"))
+	if err != nil {
+		log.Fatalf("Session store didn't load: %v\n", err)
+	}
+
 	// check for pid
 	if err = pidfile.Write(pfile); err != nil {
 		log.Fatalf("Error writing pid file: %#v", err)
 	}
 
-	// prepare for the end
-	done := make(chan error, 1)
-	trapSignals(done)
-
 	// start the backend and sync nets from the config
-	backend := NewIPTablesBackend(cfg.backendConfig())
-	backend.Open()
-	SyncNetworks(backend, cfg)
+	backend := InstrumentedBackend{NewBackend(cfg)}
+	if err := backend.Open(); err != nil {
+		abort(backend, "Backend didn't open: %v\n", err)
+	}
+	if err := SyncNetworks(backend, cfg); err != nil {
+		abort(backend, "Networks didn't sync: %v\n", err)
+	}
 
 	// start up the server
 	scfg := cfg.serverConfig()
-	s := NewServer(scfg, backend)
+	vouchers := NewVoucherStore(filepath.Join(sdir, "vouchers.json"))
+	s := NewServer(scfg, backend, sessions, vouchers)
+	s.Restore()
+	go s.RunSchedule()
+	go s.RunIdleCheck()
+	prometheus.MustRegister(NewCollector(sessions, backend))
+
+	// prepare for the end, and for reloads along the way
+	done := make(chan error, 1)
+	trapSignals(done, func() {
+		if err := reload(backend, s); err != nil {
+			log.Printf("Reload failed: %v\n", err)
+		}
+	})
 	go func() {
-		log.Printf("stargate opening at address %s\n", scfg.listenIP)
+		log.Printf("stargate opening at addresses %s\n", strings.Join(scfg.listenIPs, ", "))
 		done <- s.ListenAndServe()
 	}()
+	go func() {
+		log.Printf("stargate opening TLS on port %s\n", scfg.ports.HTTPS)
+		done <- s.ListenAndServeHTTPS()
+	}()
+
+	// start up the admin api on the control socket, and optionally the network
+	acfg := cfg.adminConfig()
+	a := NewAdmin(acfg, s, func() error { return reload(backend, s) })
+	go func() {
+		log.Printf("stargate control socket opening at %s\n", sfile)
+		done <- a.ListenAndServeSocket(sfile)
+	}()
+	if acfg.listen != "" {
+		go func() {
+			log.Printf("stargate admin api opening at address %s\n", acfg.listen)
+			done <- a.ListenAndServe()
+		}()
+	}
 
 	// we're done
 	err = <-done
@@ -64,12 +121,46 @@ func main() {
 	}
 
 	// close up shop
-	backend.Close()
-	pidfile.Remove("/var/run/stargate.pid")
+	if err := backend.Close(); err != nil {
+		status = 1
+		log.Printf("stargate didn't close cleanly: %v\n", err)
+	}
+	os.Remove(sfile)
+	pidfile.Remove(pfile)
 	log.Printf("stargate is closed\n")
 	os.Exit(status)
 }
 
+// NewBackend returns the backend selected by the config,
+// with an instance for each IP version being listened on
+func NewBackend(cfg *Config) Backend {
+	d := &DualStackBackend{}
+	for _, bc := range cfg.backendConfigs() {
+		var b Backend
+		switch cfg.Backend {
+		case "nftables":
+			b = NewNFTablesBackend(bc)
+		default:
+			b = NewIPTablesBackend(bc)
+		}
+		if bc.ipv6 {
+			d.ipv6 = b
+		} else {
+			d.ipv4 = b
+		}
+	}
+	return d
+}
+
+// abort closes the backend and exits after a failed startup
+func abort(backend Backend, format string, v ...interface{}) {
+	if err := backend.Close(); err != nil {
+		log.Printf("Backend didn't close: %v\n", err)
+	}
+	pidfile.Remove(pfile)
+	log.Fatalf(format, v...)
+}
+
 func isRoot() bool {
 	u, err := user.Current()
 	if err != nil {
@@ -78,8 +169,42 @@ func isRoot() bool {
 	return u.Uid == "0"
 }
 
-func trapSignals(done chan error) {
+func trapSignals(done chan error, reload func()) {
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-	go func() { <-sig; done <- nil }()
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for s := range sig {
+			if s == syscall.SIGHUP {
+				reload()
+				continue
+			}
+			done <- nil
+			return
+		}
+	}()
+}
+
+// reloadLock serializes reloads from SIGHUP and the admin API
+var reloadLock sync.Mutex
+
+// reload applies the config file to a running backend and server
+// A config that fails to parse leaves the running config in place
+func reload(backend Backend, s *Server) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	cfg, err := ParseConfig()
+	if err != nil {
+		return fmt.Errorf("configuration file didn't parse: %v", err)
+	}
+	if err := cfg.runtimeValidate(); err != nil {
+		return fmt.Errorf("runtime validation failed: %v", err)
+	}
+
+	if err := SyncNetworks(backend, cfg); err != nil {
+		return err
+	}
+	s.Reload(cfg.serverConfig())
+	log.Printf("stargate reloaded\n")
+	return nil
 }
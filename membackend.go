@@ -2,18 +2,10 @@ package main
 
 import (
 	"bytes"
-	"expvar"
 	"net"
 	"sync"
 )
 
-var (
-	vars = map[string]*expvar.Map{
-		"networks": expvar.NewMap("networks"),
-		"devices":  expvar.NewMap("devices"),
-	}
-)
-
 type MemBackend struct {
 	networks []Network
 	devices  map[string][]Device
@@ -30,12 +22,14 @@ func NewMemBackend() Backend {
 	}
 }
 
-func (s *MemBackend) Open() {
+func (s *MemBackend) Open() error {
 	debugf("opened memory store")
+	return nil
 }
 
-func (s *MemBackend) Close() {
+func (s *MemBackend) Close() error {
 	debugf("closed memory store")
+	return nil
 }
 
 func (s *MemBackend) HWAddrExists(hw net.HardwareAddr) bool {
@@ -51,64 +45,66 @@ func (s *MemBackend) HWAddrExists(hw net.HardwareAddr) bool {
 	return false
 }
 
+func (s *MemBackend) Devices() []Device {
+	s.dlock.Lock()
+	defer s.dlock.Unlock()
+	devices := []Device{}
+	for _, dd := range s.devices {
+		for _, d := range dd {
+			devices = append(withoutDevice(devices, d), d)
+		}
+	}
+	return devices
+}
+
 func (s *MemBackend) Networks() []Network {
 	s.nlock.Lock()
 	defer s.nlock.Unlock()
 	return s.networks
 }
 
-func (s *MemBackend) AddNetwork(network Network) {
+func (s *MemBackend) AddNetwork(network Network) error {
 	s.nlock.Lock()
 	defer s.nlock.Unlock()
 	s.networks = append(s.networks, network)
 
-	// TODO: this makes invalid expvar json
-	vars["networks"].Set(network.Name, &network.IPNet)
-	vars["devices"].Set(network.Name, new(expvar.Map).Init())
 	debugf("added network %s", network.Name)
+	return nil
 }
 
-func (s *MemBackend) RemoveNetwork(network Network) {
+func (s *MemBackend) RemoveNetwork(network Network) error {
 	s.nlock.Lock()
 	defer s.nlock.Unlock()
 	n := []Network{}
 	for _, net := range s.networks {
-		if net.Name == network.Name {
-			n = append(n, network)
+		if net.Name != network.Name {
+			n = append(n, net)
 		}
 	}
 	s.networks = n
 
 	debugf("removed network %s", network.Name)
+	return nil
 }
 
-func (s *MemBackend) AddDevice(networks []string, device Device) {
+func (s *MemBackend) AddDevice(networks []string, device Device) error {
 	s.dlock.Lock()
 	defer s.dlock.Unlock()
 	for _, network := range networks {
-		s.devices[network] = append(s.devices[network], device)
-
-		dvars := vars["devices"].Get(network).(*expvar.Map)
-		dval := new(expvar.String)
-		dval.Set(device.Name)
-		dvars.Set(device.HardwareAddr.String(), dval)
+		s.devices[network] = append(withoutDevice(s.devices[network], device), device)
 	}
 
 	debugf("added device %s to networks %v", device.HardwareAddr.String(), networks)
+	return nil
 }
 
-func (s *MemBackend) RemoveDevice(device Device) {
+func (s *MemBackend) RemoveDevice(device Device) error {
 	s.dlock.Lock()
 	defer s.dlock.Unlock()
 	for _, network := range s.networks {
-		devices := []Device{}
-		for _, d := range s.devices[network.Name] {
-			if d.Name != device.Name {
-				devices = append(devices, device)
-			}
-		}
-		s.devices[network.Name] = devices
+		s.devices[network.Name] = withoutDevice(s.devices[network.Name], device)
 	}
 
 	debugf("removed device %s", device.HardwareAddr.String())
+	return nil
 }
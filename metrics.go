@@ -0,0 +1,184 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	loginAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "stargate_login_attempts_total",
+		Help: "Login attempts by result.",
+	}, []string{"result"})
+	loginLockouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "stargate_login_lockouts_total",
+		Help: "Backoffs and lockouts begun after failed logins, by client or for everyone.",
+	}, []string{"scope"})
+	expirations = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "stargate_expirations_total",
+		Help: "Devices removed because their session expired.",
+	})
+	backendLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "stargate_backend_operation_seconds",
+		Help: "Latency of backend operations.",
+	}, []string{"operation"})
+	backendErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "stargate_backend_errors_total",
+		Help: "Failed backend operations.",
+	}, []string{"operation"})
+
+	networkDevicesDesc = prometheus.NewDesc(
+		"stargate_network_devices",
+		"Authorized devices per network.",
+		[]string{"network"}, nil)
+	tokenDevicesDesc = prometheus.NewDesc(
+		"stargate_token_devices",
+		"Authorized devices per token.",
+		[]string{"token"}, nil)
+	networkPacketsDesc = prometheus.NewDesc(
+		"stargate_network_packets_total",
+		"Packets forwarded to each network by authorized devices.",
+		[]string{"network"}, nil)
+	networkBytesDesc = prometheus.NewDesc(
+		"stargate_network_bytes_total",
+		"Bytes forwarded to each network by authorized devices.",
+		[]string{"network"}, nil)
+)
+
+func init() {
+	prometheus.MustRegister(loginAttempts, loginLockouts, expirations, backendLatency, backendErrors)
+}
+
+// Collector reports device counts from the sessions
+// and traffic counters from the backend at scrape time
+type Collector struct {
+	sessions *SessionStore
+	backend  Backend
+}
+
+// NewCollector returns a collector for a session store and backend
+func NewCollector(ss *SessionStore, b Backend) *Collector {
+	return &Collector{sessions: ss, backend: b}
+}
+
+// Describe fulfills the prometheus.Collector interface
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- networkDevicesDesc
+	ch <- tokenDevicesDesc
+	ch <- networkPacketsDesc
+	ch <- networkBytesDesc
+}
+
+// Collect fulfills the prometheus.Collector interface
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	networks := map[string]int{}
+	for _, n := range c.backend.Networks() {
+		networks[n.Name] = 0
+	}
+	tokens := map[string]int{}
+	for _, session := range c.sessions.Sessions() {
+		tokens[session.Token]++
+		for _, n := range session.Networks {
+			if _, ok := networks[n]; ok {
+				networks[n]++
+			}
+		}
+	}
+
+	for n, count := range networks {
+		ch <- prometheus.MustNewConstMetric(networkDevicesDesc, prometheus.GaugeValue, float64(count), n)
+	}
+	for t, count := range tokens {
+		ch <- prometheus.MustNewConstMetric(tokenDevicesDesc, prometheus.GaugeValue, float64(count), t)
+	}
+
+	counters, ok := c.backend.(Counters)
+	if !ok {
+		return
+	}
+	stats, err := counters.NetworkCounters()
+	if err != nil {
+		log.Printf("failed reading network counters: %v", err)
+		return
+	}
+	for n, stat := range stats {
+		ch <- prometheus.MustNewConstMetric(networkPacketsDesc, prometheus.CounterValue, float64(stat.Packets), n)
+		ch <- prometheus.MustNewConstMetric(networkBytesDesc, prometheus.CounterValue, float64(stat.Bytes), n)
+	}
+}
+
+// InstrumentedBackend records the latency of backend operations
+type InstrumentedBackend struct {
+	Backend
+}
+
+// observe records the latency and any error of an operation
+func observe(operation string, start time.Time, err error) error {
+	backendLatency.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		backendErrors.WithLabelValues(operation).Inc()
+	}
+	return err
+}
+
+// Open fulfills the Backend interface
+func (b InstrumentedBackend) Open() error {
+	start := time.Now()
+	return observe("open", start, b.Backend.Open())
+}
+
+// Close fulfills the Backend interface
+func (b InstrumentedBackend) Close() error {
+	start := time.Now()
+	return observe("close", start, b.Backend.Close())
+}
+
+// AddNetwork fulfills the Networks interface
+func (b InstrumentedBackend) AddNetwork(network Network) error {
+	start := time.Now()
+	return observe("add_network", start, b.Backend.AddNetwork(network))
+}
+
+// RemoveNetwork fulfills the Networks interface
+func (b InstrumentedBackend) RemoveNetwork(network Network) error {
+	start := time.Now()
+	return observe("remove_network", start, b.Backend.RemoveNetwork(network))
+}
+
+// AddDevice fulfills the Devices interface
+func (b InstrumentedBackend) AddDevice(networks []string, device Device) error {
+	start := time.Now()
+	return observe("add_device", start, b.Backend.AddDevice(networks, device))
+}
+
+// RemoveDevice fulfills the Devices interface
+func (b InstrumentedBackend) RemoveDevice(device Device) error {
+	start := time.Now()
+	return observe("remove_device", start, b.Backend.RemoveDevice(device))
+}
+
+// NetworkCounters fulfills the Counters interface
+// if the wrapped backend does
+func (b InstrumentedBackend) NetworkCounters() (map[string]Counter, error) {
+	counters, ok := b.Backend.(Counters)
+	if !ok {
+		return map[string]Counter{}, nil
+	}
+	start := time.Now()
+	c, err := counters.NetworkCounters()
+	return c, observe("network_counters", start, err)
+}
+
+// DeviceCounters fulfills the DeviceCounters interface
+// if the wrapped backend does
+func (b InstrumentedBackend) DeviceCounters() (map[string]Counter, error) {
+	counters, ok := b.Backend.(DeviceCounters)
+	if !ok {
+		return map[string]Counter{}, nil
+	}
+	start := time.Now()
+	c, err := counters.DeviceCounters()
+	return c, observe("device_counters", start, err)
+}
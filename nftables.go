@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// ruleset returns the stargate table with the same captive_check,
+// captive_redirect, captive_input and captive_forward behavior as
+// the iptables chains. Reverse NAT for redirected traffic is handled
+// by conntrack, so there is no equivalent of captive_return.
+func (b *NFTablesBackend) ruleset() string {
+	addr, dest := "ipv4_addr", b.config.ip
+	if b.config.ipv6 {
+		addr, dest = "ipv6_addr", "["+b.config.ip+"]"
+	}
+
+	var s bytes.Buffer
+	fmt.Fprintf(&s, "table %s {\n", b.table)
+	s.WriteString("\tset allowed {\n\t\ttype ether_addr\n\t\tcounter\n\t}\n")
+	fmt.Fprintf(&s, "\tmap networks {\n\t\ttype %s : verdict\n\t\tflags interval\n\t}\n", addr)
+
+	s.WriteString("\tchain captive_check {\n\t\ttype filter hook prerouting priority -150; policy accept;\n")
+	fmt.Fprintf(&s, "\t\t%s ether saddr @allowed return\n", b.source)
+	fmt.Fprintf(&s, "\t\t%s meta mark set 99\n", b.source)
+	s.WriteString("\t}\n")
+
+	s.WriteString("\tchain captive_redirect {\n\t\ttype nat hook prerouting priority -100; policy accept;\n")
+	fmt.Fprintf(&s, "\t\t%s meta mark 99 tcp dport 80 dnat to %s:%d\n", b.source, dest, b.config.ports.HTTP)
+	fmt.Fprintf(&s, "\t\t%s meta mark 99 tcp dport 443 dnat to %s:%d\n", b.source, dest, b.config.ports.HTTPS)
+	s.WriteString("\t}\n")
+
+	s.WriteString("\tchain captive_input {\n\t\ttype filter hook input priority 0; policy accept;\n")
+	for _, port := range b.config.ports.TCP {
+		fmt.Fprintf(&s, "\t\t%s tcp dport %d return\n", b.source, port)
+	}
+	for _, port := range b.config.ports.UDP {
+		fmt.Fprintf(&s, "\t\t%s udp dport %d return\n", b.source, port)
+	}
+	fmt.Fprintf(&s, "\t\t%s tcp dport { %d, %d } return\n", b.source, b.config.ports.HTTP, b.config.ports.HTTPS)
+	if b.config.ipv6 {
+		// Neighbor discovery has to keep working for unauthorized devices
+		fmt.Fprintf(&s, "\t\t%s meta l4proto ipv6-icmp return\n", b.source)
+	}
+	fmt.Fprintf(&s, "\t\t%s reject\n", b.source)
+	s.WriteString("\t}\n")
+
+	s.WriteString("\tchain captive_forward {\n\t\ttype filter hook forward priority 0; policy accept;\n")
+	fmt.Fprintf(&s, "\t\t%s udp dport 53 return\n", b.source)
+	fmt.Fprintf(&s, "\t\t%s meta mark 99 reject\n", b.source)
+	fmt.Fprintf(&s, "\t\t%s %s daddr vmap @networks\n", b.source, b.family)
+	s.WriteString("\t}\n")
+
+	s.WriteString("\tchain captive_masquerade {\n\t\ttype nat hook postrouting priority 100; policy accept;\n")
+	s.WriteString("\t\tmasquerade\n")
+	s.WriteString("\t}\n")
+
+	s.WriteString("}\n")
+	return s.String()
+}
+
+// closed returns the stargate table which keeps the hordes at bay
+func (b *NFTablesBackend) closed() string {
+	var s bytes.Buffer
+	fmt.Fprintf(&s, "table %s {\n", b.table)
+	s.WriteString("\tchain captive_input {\n\t\ttype filter hook input priority 0; policy accept;\n")
+	fmt.Fprintf(&s, "\t\t%s reject\n", b.source)
+	s.WriteString("\t}\n")
+	s.WriteString("\tchain captive_forward {\n\t\ttype filter hook forward priority 0; policy accept;\n")
+	fmt.Fprintf(&s, "\t\t%s reject\n", b.source)
+	s.WriteString("\t}\n")
+	s.WriteString("}\n")
+	return s.String()
+}
+
+// replace returns a script atomically replacing the stargate table
+func (b *NFTablesBackend) replace(table string) string {
+	return fmt.Sprintf("add table %s\ndelete table %s\n%s", b.table, b.table, table)
+}
+
+// nft applies a script to nftables in a single transaction
+func nft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nft: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// nftList returns the JSON listing of an nftables object
+func nftList(object string) ([]byte, error) {
+	args := append([]string{"-j", "list"}, strings.Fields(object)...)
+	out, err := exec.Command("nft", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("nft: %v", err)
+	}
+	return out, nil
+}
+
+// NFTablesBackend represents a portal backend supporting nftables
+// Each IP version gets its own stargate table
+type NFTablesBackend struct {
+	config   BackendConfig
+	family   string
+	table    string
+	source   string
+	networks []Network
+	devices  []Device
+	grants   map[string][]string
+	nlock    sync.Mutex
+	dlock    sync.Mutex
+}
+
+// NewNFTablesBackend returns a backend provided a config
+func NewNFTablesBackend(cfg BackendConfig) Backend {
+	if _, err := exec.LookPath("nft"); err != nil {
+		panic("nftables not supported")
+	}
+	_, ipnet, err := net.ParseCIDR(cfg.net)
+	if err != nil {
+		panic("managed network can't be parsed")
+	}
+	family := "ip"
+	if cfg.ipv6 {
+		family = "ip6"
+	}
+	return &NFTablesBackend{
+		config:   cfg,
+		family:   family,
+		table:    family + " stargate",
+		source:   fmt.Sprintf("%s saddr %s", family, ipnet.String()),
+		networks: []Network{},
+		devices:  []Device{},
+		grants:   map[string][]string{},
+		nlock:    sync.Mutex{},
+		dlock:    sync.Mutex{},
+	}
+}
+
+// Open will replace the stargate table with the portal ruleset
+func (b *NFTablesBackend) Open() error {
+	if err := nft(b.replace(b.ruleset())); err != nil {
+		return err
+	}
+
+	debugf("opened nftables backend for %s", b.config.net)
+	return nil
+}
+
+// Close will replace the stargate table with rules
+// to firewall the managed network
+func (b *NFTablesBackend) Close() error {
+	b.nlock.Lock()
+	b.networks = []Network{}
+	b.nlock.Unlock()
+
+	b.dlock.Lock()
+	b.devices = []Device{}
+	b.grants = map[string][]string{}
+	b.dlock.Unlock()
+
+	if err := nft(b.replace(b.closed())); err != nil {
+		return err
+	}
+
+	debugf("closed nftables backend for %s", b.config.net)
+	return nil
+}
+
+// HWAddrExists checks if the specified mac addr is known to the portal
+func (b *NFTablesBackend) HWAddrExists(hw net.HardwareAddr) bool {
+	b.dlock.Lock()
+	defer b.dlock.Unlock()
+	for _, d := range b.devices {
+		if bytes.Equal(d.HardwareAddr, hw) {
+			return true
+		}
+	}
+	return false
+}
+
+// Devices fulfills the Devices interface
+func (b *NFTablesBackend) Devices() []Device {
+	b.dlock.Lock()
+	defer b.dlock.Unlock()
+	return append([]Device{}, b.devices...)
+}
+
+// Networks fulfills the ListNetworks interface
+func (b *NFTablesBackend) Networks() []Network {
+	b.nlock.Lock()
+	defer b.nlock.Unlock()
+	return b.networks
+}
+
+// AddNetwork fulfills the Networks interface
+func (b *NFTablesBackend) AddNetwork(network Network) error {
+	b.nlock.Lock()
+	defer b.nlock.Unlock()
+
+	var s bytes.Buffer
+	fmt.Fprintf(&s, "add set %s allowed_%s { type ether_addr; }\n", b.table, network.Name)
+	fmt.Fprintf(&s, "add chain %s access_%s\n", b.table, network.Name)
+	fmt.Fprintf(&s, "add rule %s access_%s ether saddr @allowed_%s counter accept\n", b.table, network.Name, network.Name)
+	fmt.Fprintf(&s, "add rule %s access_%s drop\n", b.table, network.Name)
+	fmt.Fprintf(&s, "add element %s networks { %s : jump access_%s }\n", b.table, network.String(), network.Name)
+	if err := nft(s.String()); err != nil {
+		return err
+	}
+	b.networks = append(b.networks, network)
+
+	debugf("network %s added", network.Name)
+	return nil
+}
+
+// RemoveNetwork fulfills the Networks interface
+func (b *NFTablesBackend) RemoveNetwork(network Network) error {
+	b.nlock.Lock()
+	defer b.nlock.Unlock()
+	networks := []Network{}
+	for _, n := range b.networks {
+		if n.Name != network.Name {
+			networks = append(networks, n)
+		}
+	}
+	b.networks = networks
+
+	var s bytes.Buffer
+	fmt.Fprintf(&s, "delete element %s networks { %s }\n", b.table, network.String())
+	fmt.Fprintf(&s, "flush chain %s access_%s\n", b.table, network.Name)
+	fmt.Fprintf(&s, "delete chain %s access_%s\n", b.table, network.Name)
+	fmt.Fprintf(&s, "delete set %s allowed_%s\n", b.table, network.Name)
+	if err := nft(s.String()); err != nil {
+		return err
+	}
+
+	debugf("network %s removed", network.Name)
+	return nil
+}
+
+// AddDevice fulfills the Device interface
+// Networks the backend doesn't know, e.g. removed by a reload, are skipped
+// so they don't fail the whole transaction
+func (b *NFTablesBackend) AddDevice(networks []string, device Device) error {
+	b.dlock.Lock()
+	defer b.dlock.Unlock()
+	hw := device.HardwareAddr.String()
+	networks = networksOf(b, networks)
+
+	var s bytes.Buffer
+	fmt.Fprintf(&s, "add element %s allowed { %s }\n", b.table, hw)
+	for _, n := range networks {
+		fmt.Fprintf(&s, "add element %s allowed_%s { %s }\n", b.table, n, hw)
+	}
+	if err := nft(s.String()); err != nil {
+		return err
+	}
+	b.devices = append(withoutDevice(b.devices, device), device)
+	b.grants[hw] = networks
+
+	debugf("added device %s to networks %v", hw, networks)
+	return nil
+}
+
+// RemoveDevice fulfills the Device interface
+func (b *NFTablesBackend) RemoveDevice(device Device) error {
+	b.dlock.Lock()
+	defer b.dlock.Unlock()
+	hw := device.HardwareAddr.String()
+	granted, ok := b.grants[hw]
+	if !ok {
+		return nil
+	}
+
+	var s bytes.Buffer
+	fmt.Fprintf(&s, "delete element %s allowed { %s }\n", b.table, hw)
+	for _, n := range granted {
+		if b.hasNetwork(n) {
+			fmt.Fprintf(&s, "delete element %s allowed_%s { %s }\n", b.table, n, hw)
+		}
+	}
+	if err := nft(s.String()); err != nil {
+		return err
+	}
+	b.devices = withoutDevice(b.devices, device)
+	delete(b.grants, hw)
+
+	debugf("removed device %s", hw)
+	return nil
+}
+
+// hasNetwork checks if the named network is known to the backend
+func (b *NFTablesBackend) hasNetwork(name string) bool {
+	for _, n := range b.Networks() {
+		if n.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// NetworkCounters fulfills the Counters interface by reading
+// the counter of each network's access rule
+func (b *NFTablesBackend) NetworkCounters() (map[string]Counter, error) {
+	counters := map[string]Counter{}
+	for _, n := range b.Networks() {
+		out, err := nftList(fmt.Sprintf("chain %s access_%s", b.table, n.Name))
+		if err != nil {
+			return nil, err
+		}
+
+		listing := struct {
+			Nftables []struct {
+				Rule *struct {
+					Expr []struct {
+						Counter *Counter `json:"counter"`
+					} `json:"expr"`
+				} `json:"rule"`
+			} `json:"nftables"`
+		}{}
+		if err := json.Unmarshal(out, &listing); err != nil {
+			return nil, err
+		}
+
+		c := Counter{}
+		for _, item := range listing.Nftables {
+			if item.Rule == nil {
+				continue
+			}
+			for _, expr := range item.Rule.Expr {
+				if expr.Counter != nil {
+					c.Packets += expr.Counter.Packets
+					c.Bytes += expr.Counter.Bytes
+				}
+			}
+		}
+		counters[n.Name] = c
+	}
+	return counters, nil
+}
+
+// DeviceCounters fulfills the DeviceCounters interface by reading
+// the counter of each device's element in the allowed set
+func (b *NFTablesBackend) DeviceCounters() (map[string]Counter, error) {
+	out, err := nftList(fmt.Sprintf("set %s allowed", b.table))
+	if err != nil {
+		return nil, err
+	}
+
+	listing := struct {
+		Nftables []struct {
+			Set *struct {
+				Elem []struct {
+					Elem *struct {
+						Val     string   `json:"val"`
+						Counter *Counter `json:"counter"`
+					} `json:"elem"`
+				} `json:"elem"`
+			} `json:"set"`
+		} `json:"nftables"`
+	}{}
+	if err := json.Unmarshal(out, &listing); err != nil {
+		return nil, err
+	}
+
+	counters := map[string]Counter{}
+	for _, item := range listing.Nftables {
+		if item.Set == nil {
+			continue
+		}
+		for _, e := range item.Set.Elem {
+			if e.Elem == nil || e.Elem.Counter == nil {
+				continue
+			}
+			hw, err := net.ParseMAC(e.Elem.Val)
+			if err != nil {
+				continue
+			}
+			counters[hw.String()] = *e.Elem.Counter
+		}
+	}
+	return counters, nil
+}
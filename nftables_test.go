@@ -0,0 +1,135 @@
+package main
+
+import "testing"
+
+// nftBackend returns a backend as NewNFTablesBackend would,
+// without needing nft installed
+func nftBackend(ip, net string, ipv6 bool) *NFTablesBackend {
+	cfg := BackendConfig{net: net, ip: ip, ipv6: ipv6}
+	cfg.ports.HTTP = 8080
+	cfg.ports.HTTPS = 8443
+	cfg.ports.TCP = []int{22}
+	cfg.ports.UDP = []int{53, 67}
+	family := "ip"
+	if ipv6 {
+		family = "ip6"
+	}
+	return &NFTablesBackend{
+		config: cfg,
+		family: family,
+		table:  family + " stargate",
+		source: family + " saddr " + net,
+	}
+}
+
+func TestRuleset(t *testing.T) {
+	expected := `table ip stargate {
+	set allowed {
+		type ether_addr
+		counter
+	}
+	map networks {
+		type ipv4_addr : verdict
+		flags interval
+	}
+	chain captive_check {
+		type filter hook prerouting priority -150; policy accept;
+		ip saddr 10.0.0.0/24 ether saddr @allowed return
+		ip saddr 10.0.0.0/24 meta mark set 99
+	}
+	chain captive_redirect {
+		type nat hook prerouting priority -100; policy accept;
+		ip saddr 10.0.0.0/24 meta mark 99 tcp dport 80 dnat to 10.0.0.1:8080
+		ip saddr 10.0.0.0/24 meta mark 99 tcp dport 443 dnat to 10.0.0.1:8443
+	}
+	chain captive_input {
+		type filter hook input priority 0; policy accept;
+		ip saddr 10.0.0.0/24 tcp dport 22 return
+		ip saddr 10.0.0.0/24 udp dport 53 return
+		ip saddr 10.0.0.0/24 udp dport 67 return
+		ip saddr 10.0.0.0/24 tcp dport { 8080, 8443 } return
+		ip saddr 10.0.0.0/24 reject
+	}
+	chain captive_forward {
+		type filter hook forward priority 0; policy accept;
+		ip saddr 10.0.0.0/24 udp dport 53 return
+		ip saddr 10.0.0.0/24 meta mark 99 reject
+		ip saddr 10.0.0.0/24 ip daddr vmap @networks
+	}
+	chain captive_masquerade {
+		type nat hook postrouting priority 100; policy accept;
+		masquerade
+	}
+}
+`
+	if rules := nftBackend("10.0.0.1", "10.0.0.0/24", false).ruleset(); rules != expected {
+		t.Errorf("ruleset is\n%s\nexpected\n%s", rules, expected)
+	}
+}
+
+func TestRulesetIPv6(t *testing.T) {
+	expected := `table ip6 stargate {
+	set allowed {
+		type ether_addr
+		counter
+	}
+	map networks {
+		type ipv6_addr : verdict
+		flags interval
+	}
+	chain captive_check {
+		type filter hook prerouting priority -150; policy accept;
+		ip6 saddr fd00::/64 ether saddr @allowed return
+		ip6 saddr fd00::/64 meta mark set 99
+	}
+	chain captive_redirect {
+		type nat hook prerouting priority -100; policy accept;
+		ip6 saddr fd00::/64 meta mark 99 tcp dport 80 dnat to [fd00::1]:8080
+		ip6 saddr fd00::/64 meta mark 99 tcp dport 443 dnat to [fd00::1]:8443
+	}
+	chain captive_input {
+		type filter hook input priority 0; policy accept;
+		ip6 saddr fd00::/64 tcp dport 22 return
+		ip6 saddr fd00::/64 udp dport 53 return
+		ip6 saddr fd00::/64 udp dport 67 return
+		ip6 saddr fd00::/64 tcp dport { 8080, 8443 } return
+		ip6 saddr fd00::/64 meta l4proto ipv6-icmp return
+		ip6 saddr fd00::/64 reject
+	}
+	chain captive_forward {
+		type filter hook forward priority 0; policy accept;
+		ip6 saddr fd00::/64 udp dport 53 return
+		ip6 saddr fd00::/64 meta mark 99 reject
+		ip6 saddr fd00::/64 ip6 daddr vmap @networks
+	}
+	chain captive_masquerade {
+		type nat hook postrouting priority 100; policy accept;
+		masquerade
+	}
+}
+`
+	if rules := nftBackend("fd00::1", "fd00::/64", true).ruleset(); rules != expected {
+		t.Errorf("ruleset is\n%s\nexpected\n%s", rules, expected)
+	}
+}
+
+func TestClosed(t *testing.T) {
+	expected := `table ip stargate {
+	chain captive_input {
+		type filter hook input priority 0; policy accept;
+		ip saddr 10.0.0.0/24 reject
+	}
+	chain captive_forward {
+		type filter hook forward priority 0; policy accept;
+		ip saddr 10.0.0.0/24 reject
+	}
+}
+`
+	b := nftBackend("10.0.0.1", "10.0.0.0/24", false)
+	if rules := b.closed(); rules != expected {
+		t.Errorf("closed ruleset is\n%s\nexpected\n%s", rules, expected)
+	}
+	if script := b.replace(expected); script != "add table ip stargate\ndelete table ip stargate\n"+expected {
+		t.Errorf("replace script is\n%s", script)
+	}
+}
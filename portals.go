@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// defaultPortal serves devices which no configured portal matches
+var defaultPortal = Portal{Name: "default", Template: "index.html"}
+
+// Portal returns the portal for a request
+// A portal's path is matched first, for requests meant for the portal
+// itself, then its subnets, by the device's address
+func (s *Server) Portal(req *http.Request) Portal {
+	s.lock.RLock()
+	portals := s.portals
+	s.lock.RUnlock()
+
+	if !s.foreignHost(req) {
+		for _, p := range portals {
+			if p.MatchesPath(req.URL.Path) {
+				return p
+			}
+		}
+	}
+	ip := remoteIP(req.RemoteAddr)
+	for _, p := range portals {
+		if p.Contains(ip) {
+			return p
+		}
+	}
+	return defaultPortal
+}
+
+// MatchesPath checks if a URL path is the portal's path or below it
+func (p Portal) MatchesPath(path string) bool {
+	return p.Path != "" && (path == p.Path || strings.HasPrefix(path, p.Path+"/"))
+}
+
+// Contains checks if an IP is in one of the portal's subnets
+func (p Portal) Contains(ip net.IP) bool {
+	for _, subnet := range p.subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows checks if a token can be used to log in on the portal
+// A portal without tokens allows all of them
+func (p Portal) Allows(token string) bool {
+	return len(p.TokenNames) == 0 || p.Lists(token)
+}
+
+// Lists checks if a token is named in the portal's tokens
+func (p Portal) Lists(token string) bool {
+	for _, name := range p.TokenNames {
+		if name == token {
+			return true
+		}
+	}
+	return false
+}
+
+// offersClickthrough checks if a clickthrough token can be used on a portal
+// A clickthrough token named by any portal is only offered on the portals
+// naming it, so it doesn't show up on portals which allow all tokens
+func offersClickthrough(portals []Portal, portal Portal, token string) bool {
+	if portal.Lists(token) {
+		return true
+	}
+	for _, p := range portals {
+		if p.Lists(token) {
+			return false
+		}
+	}
+	return portal.Allows(token)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPortalParse(t *testing.T) {
+	cases := []struct {
+		portal Portal
+		path   string
+		ok     bool
+	}{
+		{Portal{Name: "staff", Path: "staff/"}, "/staff", true},
+		{Portal{Name: "guest", Subnets: []string{"10.0.2.0/24"}}, "", true},
+		{Portal{Name: "none"}, "", false},
+		{Portal{Path: "/nameless"}, "", false},
+		{Portal{Name: "root", Path: "/"}, "", false},
+		{Portal{Name: "logout", Path: "/logout"}, "", false},
+		{Portal{Name: "static", Path: "/static"}, "", false},
+		{Portal{Name: "static", Path: "/static/staff"}, "", false},
+		{Portal{Name: "captive", Path: "/captive-portal"}, "", false},
+		{Portal{Name: "captive", Path: "/captive-portal/api/x"}, "", false},
+		{Portal{Name: "statics", Path: "/statics"}, "/statics", true},
+		{Portal{Name: "subnet", Subnets: []string{"10.0.2.1"}}, "", false},
+		{Portal{Name: "redirect", Path: "/r", Redirect: "%zz"}, "", false},
+	}
+	for _, c := range cases {
+		p := c.portal
+		err := p.parse()
+		if (err == nil) != c.ok {
+			t.Errorf("%+v parsed with %v, expected ok %v", c.portal, err, c.ok)
+			continue
+		}
+		if err == nil && (p.Path != c.path || p.Template != "index.html") {
+			t.Errorf("%+v parsed as path %q template %q", c.portal, p.Path, p.Template)
+		}
+	}
+}
+
+func TestPortalMatch(t *testing.T) {
+	p := Portal{Name: "staff", Path: "/staff", Subnets: []string{"10.0.2.0/24", "fd00:2::/64"}, TokenNames: []string{"office"}}
+	if err := p.parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := map[string]bool{
+		"/staff":      true,
+		"/staff/":     true,
+		"/staff/help": true,
+		"/staffroom":  false,
+		"/":           false,
+		"/guest":      false,
+	}
+	for path, match := range paths {
+		if p.MatchesPath(path) != match {
+			t.Errorf("path %s matches: expected %v", path, match)
+		}
+	}
+	if (Portal{}).MatchesPath("/") {
+		t.Error("portal without a path matched")
+	}
+
+	ips := map[string]bool{
+		"10.0.2.10": true,
+		"10.0.3.10": false,
+		"fd00:2::1": true,
+		"fd00:3::1": false,
+	}
+	for ip, contained := range ips {
+		if p.Contains(net.ParseIP(ip)) != contained {
+			t.Errorf("%s contained: expected %v", ip, contained)
+		}
+	}
+	if p.Contains(nil) {
+		t.Error("nil ip contained")
+	}
+
+	if !p.Allows("office") || p.Allows("guest") {
+		t.Error("portal allows the wrong tokens")
+	}
+	if !(Portal{}).Allows("guest") {
+		t.Error("portal without tokens doesn't allow all of them")
+	}
+}
+
+func TestClickthroughToken(t *testing.T) {
+	guest := Portal{Name: "guest", Subnets: []string{"10.0.2.0/24"}, TokenNames: []string{"guest"}}
+	open := Portal{Name: "open", Subnets: []string{"10.0.3.0/24"}}
+	s := &Server{}
+	s.portals = []Portal{guest, open}
+	s.tokens = []Token{
+		{Name: "guest", Type: "clickthrough"},
+		{Name: "office", Keys: []string{"staff"}},
+	}
+
+	if token, ok := s.ClickthroughToken(guest); !ok || token.Name != "guest" {
+		t.Error("guest portal doesn't offer its clickthrough token")
+	}
+	if _, ok := s.ClickthroughToken(open); ok {
+		t.Error("portal allowing all tokens offers another portal's clickthrough token")
+	}
+	if _, ok := s.ClickthroughToken(defaultPortal); ok {
+		t.Error("default portal offers another portal's clickthrough token")
+	}
+
+	s.portals = nil
+	if _, ok := s.ClickthroughToken(defaultPortal); !ok {
+		t.Error("default portal doesn't offer a clickthrough token named by no portal")
+	}
+}
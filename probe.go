@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Probe is a connectivity check an operating system makes to find out
+// if it is behind a captive portal
+type Probe struct {
+	Host   string
+	Path   string
+	Status int
+	Body   string
+}
+
+// Probes are answered with the portal page until a device is authorized,
+// then with exactly what the client expects, so it closes its sign-in sheet
+var Probes = []Probe{
+	// Apple
+	{"captive.apple.com", "/hotspot-detect.html", http.StatusOK, "<HTML><HEAD><TITLE>Success</TITLE></HEAD><BODY>Success</BODY></HTML>"},
+	{"www.apple.com", "/library/test/success.html", http.StatusOK, "<HTML><HEAD><TITLE>Success</TITLE></HEAD><BODY>Success</BODY></HTML>"},
+	// Android and ChromeOS
+	{"connectivitycheck.gstatic.com", "/generate_204", http.StatusNoContent, ""},
+	{"connectivitycheck.android.com", "/generate_204", http.StatusNoContent, ""},
+	{"clients3.google.com", "/generate_204", http.StatusNoContent, ""},
+	{"www.google.com", "/gen_204", http.StatusNoContent, ""},
+	// Windows
+	{"www.msftconnecttest.com", "/connecttest.txt", http.StatusOK, "Microsoft Connect Test"},
+	{"www.msftncsi.com", "/ncsi.txt", http.StatusOK, "Microsoft NCSI"},
+	// Firefox
+	{"detectportal.firefox.com", "/success.txt", http.StatusOK, "success\n"},
+}
+
+// probeFor returns the probe a request is making, if any
+func probeFor(req *http.Request) (Probe, bool) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, p := range Probes {
+		if strings.EqualFold(host, p.Host) && req.URL.Path == p.Path {
+			return p, true
+		}
+	}
+	return Probe{}, false
+}
+
+// Answer responds to a probe as the internet would
+func (p Probe) Answer(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	if p.Body != "" {
+		w.Header().Set("Content-Type", "text/plain")
+		if strings.HasPrefix(p.Body, "<HTML>") {
+			w.Header().Set("Content-Type", "text/html")
+		}
+	}
+	w.WriteHeader(p.Status)
+	w.Write([]byte(p.Body))
+}
+
+// AnswerProbe sends unauthorized devices to the portal page,
+// and gives authorized devices the response their probe expects
+func (s *Server) AnswerProbe(w http.ResponseWriter, req *http.Request, p Probe) {
+	hw, err := HardwareAddr(req.RemoteAddr)
+	if err == nil && s.backend.HWAddrExists(hw) {
+		debugf("answering %s probe from authorized device %s", p.Host, hw)
+		p.Answer(w)
+		return
+	}
+
+	scheme := "http"
+	if !s.httpLogin {
+		scheme = "https"
+	}
+	debugf("redirecting %s probe from %s", p.Host, req.RemoteAddr)
+	http.Redirect(w, req, s.PortalURL(req, scheme, "/"), http.StatusFound)
+}
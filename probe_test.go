@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProbeFor(t *testing.T) {
+	cases := []struct {
+		url  string
+		host string
+		ok   bool
+	}{
+		{"/hotspot-detect.html", "captive.apple.com", true},
+		{"/hotspot-detect.html", "Captive.Apple.COM", true},
+		{"/hotspot-detect.html", "captive.apple.com:80", true},
+		{"/generate_204", "connectivitycheck.gstatic.com", true},
+		{"/generate_204?x=1", "clients3.google.com", true},
+		{"/success.txt", "detectportal.firefox.com", true},
+		{"/generate_204", "captive.apple.com", false},
+		{"/hotspot-detect.html/", "captive.apple.com", false},
+		{"/Generate_204", "connectivitycheck.gstatic.com", false},
+		{"/generate_204", "portal.example.com", false},
+		{"/", "captive.apple.com", false},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", c.url, nil)
+		req.Host = c.host
+		p, ok := probeFor(req)
+		if ok != c.ok {
+			t.Errorf("%s%s matched %v, expected %v", c.host, c.url, ok, c.ok)
+		}
+		if ok && p.Path != req.URL.Path {
+			t.Errorf("%s%s matched the probe for %s%s", c.host, c.url, p.Host, p.Path)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The page a device was after when it was sent to the portal is carried
+// through the login form in a "return" parameter, signed so the portal
+// can't be used to redirect to arbitrary pages
+// The signature covers the device's IP and an expiry, so a parameter
+// made up by one device can't be handed to another
+
+// returnTTL is how long a return parameter can be used to log in
+const returnTTL = 30 * time.Minute
+
+// signReturn returns the signed return parameter for a URL,
+// valid for a device IP until expires
+func (s *Server) signReturn(u string, ip net.IP, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(u)) + "." + exp + "." +
+		base64.RawURLEncoding.EncodeToString(s.returnMAC(u, ip, exp))
+}
+
+// verifyReturn returns the URL of a return parameter with a valid
+// signature for a device IP, which hasn't expired
+func (s *Server) verifyReturn(param string, ip net.IP, now time.Time) (string, bool) {
+	parts := strings.Split(param, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	u, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", false
+	}
+	if !hmac.Equal(sig, s.returnMAC(string(u), ip, parts[1])) {
+		return "", false
+	}
+	if !now.Before(time.Unix(expires, 0)) {
+		return "", false
+	}
+	return string(u), true
+}
+
+// returnMAC returns the HMAC of a return URL for a device IP and expiry
+func (s *Server) returnMAC(u string, ip net.IP, expires string) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(ip.String() + "\x00" + expires + "\x00" + u))
+	return mac.Sum(nil)
+}
+
+// returnParam returns the return parameter to carry through the login form
+// It is passed along if the request has a valid one, or made up from
+// the request when it was meant for another host and sent to the portal
+func (s *Server) returnParam(req *http.Request) string {
+	ip := remoteIP(req.RemoteAddr)
+	if param := req.FormValue("return"); param != "" {
+		if _, ok := s.verifyReturn(param, ip, time.Now()); ok {
+			return param
+		}
+	}
+	if req.Method != "GET" || !s.foreignHost(req) {
+		return ""
+	}
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return s.signReturn(scheme+"://"+req.Host+req.URL.RequestURI(), ip, time.Now().Add(returnTTL))
+}
+
+// foreignHost checks if a request was meant for a host other than the portal
+func (s *Server) foreignHost(req *http.Request) bool {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if host == "" || certificateCovers(s.certificate, host) {
+		return false
+	}
+	for _, ip := range s.listenIPs {
+		if net.ParseIP(ip).Equal(net.ParseIP(host)) {
+			return false
+		}
+	}
+	return true
+}
+
+// RedirectAfterLogin sends a device to its token's or portal's redirect,
+// the page it was originally after, or the configured redirect
+func (s *Server) RedirectAfterLogin(w http.ResponseWriter, req *http.Request, token Token) {
+	redirect := token.Redirect
+	if redirect == "" {
+		redirect = s.Portal(req).Redirect
+	}
+	if redirect != "" {
+		http.Redirect(w, req, redirect, http.StatusFound)
+		return
+	}
+	if u, ok := s.verifyReturn(req.FormValue("return"), remoteIP(req.RemoteAddr), time.Now()); ok {
+		http.Redirect(w, req, u, http.StatusFound)
+		return
+	}
+	s.Redirect(w, req)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReturnSignature(t *testing.T) {
+	s := &Server{secret: []byte("secret")}
+	ip := net.ParseIP("192.168.1.10")
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	u := "http://example.com/page?q=1"
+
+	param := s.signReturn(u, ip, now.Add(returnTTL))
+	if got, ok := s.verifyReturn(param, ip, now); !ok || got != u {
+		t.Fatalf("verify failed: %q %v", got, ok)
+	}
+
+	other := s.signReturn("http://evil.example/", ip, now.Add(returnTTL))
+	cases := map[string]struct {
+		param string
+		ip    net.IP
+		now   time.Time
+	}{
+		"other device":  {param, net.ParseIP("192.168.1.11"), now},
+		"expired":       {param, ip, now.Add(returnTTL)},
+		"swapped url":   {other[:len(other)-43] + param[len(param)-43:], ip, now},
+		"extended":      {param[:len(param)-44] + "9" + param[len(param)-44:], ip, now},
+		"no signature":  {"aHR0cDovL2V4YW1wbGUuY29tLw", ip, now},
+		"bad signature": {param[:len(param)-1] + "A", ip, now},
+	}
+	for name, c := range cases {
+		if _, ok := s.verifyReturn(c.param, c.ip, c.now); ok {
+			t.Errorf("%s verified", name)
+		}
+	}
+
+	s.secret = []byte("restarted")
+	if _, ok := s.verifyReturn(param, ip, now); ok {
+		t.Error("verified with another secret")
+	}
+}
+
+func TestForeignHost(t *testing.T) {
+	s := &Server{}
+	s.listenIPs = []string{"192.168.1.1", "fd00::1"}
+	cases := map[string]bool{
+		"192.168.1.1":      false,
+		"192.168.1.1:8080": false,
+		"[fd00::1]:8443":   false,
+		"fd00::1":          false,
+		"example.com":      true,
+		"example.com:80":   true,
+		"192.168.1.2":      true,
+	}
+	for host, foreign := range cases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = host
+		if s.foreignHost(req) != foreign {
+			t.Errorf("%s foreign: expected %v", host, foreign)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// Window is a time of day range on some days of the week,
+// in local time. A window ending before it starts runs past midnight.
+type Window struct {
+	days  [7]bool
+	start int
+	end   int
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseWindow parses a window like "mon-fri 07:00-21:00",
+// "sat,sun 09:00-12:00" or "daily 22:00-06:00"
+func parseWindow(s string) (w Window, err error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return w, fmt.Errorf("schedule %q should look like \"mon-fri 07:00-21:00\"", s)
+	}
+
+	if fields[0] == "daily" {
+		fields[0] = "sun-sat"
+	}
+	for _, r := range strings.Split(fields[0], ",") {
+		from, to := r, r
+		if i := strings.Index(r, "-"); i >= 0 {
+			from, to = r[:i], r[i+1:]
+		}
+		f, t := weekday(from), weekday(to)
+		if f < 0 || t < 0 {
+			return w, fmt.Errorf("schedule %q has unknown days %s", s, r)
+		}
+		for d := f; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == t {
+				break
+			}
+		}
+	}
+
+	times := strings.Split(fields[1], "-")
+	if len(times) != 2 {
+		return w, fmt.Errorf("schedule %q should have a time range like 07:00-21:00", s)
+	}
+	if w.start, err = minuteOfDay(times[0]); err != nil {
+		return w, err
+	}
+	if w.end, err = minuteOfDay(times[1]); err != nil {
+		return w, err
+	}
+	if w.start == w.end {
+		return w, fmt.Errorf("schedule %q has an empty time range", s)
+	}
+	return w, nil
+}
+
+func weekday(s string) int {
+	for i, d := range weekdays {
+		if d == strings.ToLower(s) {
+			return i
+		}
+	}
+	return -1
+}
+
+// minuteOfDay parses HH:MM, allowing 24:00 as the end of the day
+func minuteOfDay(s string) (int, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil {
+		return 0, fmt.Errorf("time %s should look like 07:00", s)
+	}
+	if h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("time %s is out of range", s)
+	}
+	return h*60 + m, nil
+}
+
+// Contains checks if a time falls within the window
+func (w Window) Contains(t time.Time) bool {
+	day, minute := int(t.Weekday()), t.Hour()*60+t.Minute()
+	if w.start < w.end {
+		return w.days[day] && minute >= w.start && minute < w.end
+	}
+	yesterday := (day + 6) % 7
+	return (w.days[day] && minute >= w.start) || (w.days[yesterday] && minute < w.end)
+}
+
+// parseValidity parses a valid_from or valid_until time
+// A date alone is the start of that day, or its end when until is set
+func parseValidity(s string, until bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02T15:04", s, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return t, fmt.Errorf("time %s should look like 2006-01-02 or 2006-01-02T15:04", s)
+	}
+	if until {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// Expired checks if the token's validity has ended
+func (t Token) Expired(now time.Time) bool {
+	return !t.validUntil.IsZero() && !now.Before(t.validUntil)
+}
+
+// Active checks if the token is valid and within its schedule
+func (t Token) Active(now time.Time) bool {
+	if t.Expired(now) || now.Before(t.validFrom) {
+		return false
+	}
+	if len(t.windows) == 0 {
+		return true
+	}
+	for _, w := range t.windows {
+		if w.Contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// RunSchedule applies token schedules at the start of every minute,
+// which is when windows open and close
+func (s *Server) RunSchedule() {
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		s.applySchedule(time.Now())
+	}
+}
+
+// applySchedule revokes devices whose token is no longer valid,
+// suspends devices whose token is outside its schedule,
+// and resumes them once it is back inside
+// A suspended device keeps its session, and its expiry keeps running
+// Runs from the ticker and from reloads are serialized, so a device
+// isn't suspended and resumed at once
+func (s *Server) applySchedule(now time.Time) {
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+
+	for _, session := range s.sessions.Sessions() {
+		hw, err := net.ParseMAC(session.HardwareAddr)
+		if err != nil {
+			continue
+		}
+		token, ok := s.TokenNamed(session.Token)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case token.Expired(now):
+			if err := s.Revoke(hw, "token "+token.Name+" no longer valid"); err != nil {
+				log.Printf("failed removing device %s: %v", hw, err)
+			}
+
+		case !token.Active(now) && !s.Suspended(hw):
+			if err := s.backend.RemoveDevice(session.Device(hw)); err != nil {
+				log.Printf("failed suspending device %s: %v", hw, err)
+				continue
+			}
+			s.suspend(hw, true)
+			log.Printf("device %s suspended outside the schedule of %s", hw, token.Name)
+
+		case token.Active(now) && s.Suspended(hw):
+			if err := s.backend.AddDevice(session.Networks, session.Device(hw)); err != nil {
+				log.Printf("failed resuming device %s: %v", hw, err)
+				continue
+			}
+			s.suspend(hw, false)
+			log.Printf("device %s resumed within the schedule of %s", hw, token.Name)
+		}
+	}
+}
+
+// Suspended checks if a device is suspended by its token's schedule
+func (s *Server) Suspended(hw net.HardwareAddr) bool {
+	s.slock.Lock()
+	defer s.slock.Unlock()
+	return s.suspended[hw.String()]
+}
+
+// suspend marks a device as suspended or not
+func (s *Server) suspend(hw net.HardwareAddr, suspended bool) {
+	s.slock.Lock()
+	defer s.slock.Unlock()
+	if suspended {
+		s.suspended[hw.String()] = true
+	} else {
+		delete(s.suspended, hw.String())
+	}
+}
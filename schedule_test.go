@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindow(t *testing.T) {
+	cases := []struct {
+		window string
+		at     string
+		within bool
+	}{
+		{"mon-fri 07:00-21:00", "2026-10-14 07:00", true},  // wednesday
+		{"mon-fri 07:00-21:00", "2026-10-14 21:00", false}, // wednesday
+		{"mon-fri 07:00-21:00", "2026-10-17 12:00", false}, // saturday
+		{"sat,sun 09:00-12:00", "2026-10-18 11:59", true},  // sunday
+		{"fri 22:00-02:00", "2026-10-17 01:30", true},      // saturday night
+		{"fri 22:00-02:00", "2026-10-18 01:30", false},     // sunday night
+		{"daily 00:00-24:00", "2026-10-18 23:59", true},
+	}
+	for _, c := range cases {
+		w, err := parseWindow(c.window)
+		if err != nil {
+			t.Fatalf("%s failed: %v", c.window, err)
+		}
+		at, _ := time.ParseInLocation("2006-01-02 15:04", c.at, time.Local)
+		if w.Contains(at) != c.within {
+			t.Errorf("%s contains %s: expected %v", c.window, c.at, c.within)
+		}
+	}
+
+	for _, bad := range []string{"weekdays 07:00-21:00", "mon 7am-9pm", "mon 07:00-07:00", "mon 07:00-25:00"} {
+		if _, err := parseWindow(bad); err == nil {
+			t.Errorf("%s parsed", bad)
+		}
+	}
+}
@@ -1,13 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"html/template"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
+	"os/exec"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mostlygeek/arp"
@@ -18,45 +28,318 @@ type Server struct {
 	*http.Server
 	*http.ServeMux
 	ServerConfig
-	templates *template.Template
+	TLSServer *http.Server
+	secret    []byte
 	backend   Backend
+	sessions  *SessionStore
+	vouchers  *VoucherStore
+	limiter   *Limiter
+	timers    map[string]*time.Timer
+	lock      sync.RWMutex
+	suspended map[string]bool
+	tlock     sync.Mutex
+	alock     sync.Mutex
+	slock     sync.Mutex
+	wlock     sync.Mutex
 }
 
-// NewServer creates a server from a config and backend
-func NewServer(c ServerConfig, b Backend) *Server {
+// NewServer creates a server from a config, backend, session store
+// and voucher store
+func NewServer(c ServerConfig, b Backend, ss *SessionStore, vs *VoucherStore) *Server {
 	s := &Server{}
 	s.ServerConfig = c
 	s.backend = b
-	s.templates = getTemplates()
+	s.sessions = ss
+	s.vouchers = vs
+	s.limiter = NewLimiter(c.limits)
+	s.timers = map[string]*time.Timer{}
+	s.suspended = map[string]bool{}
+	s.secret = make([]byte, 32)
+	if _, err := rand.Read(s.secret); err != nil {
+		log.Fatalf("failed generating secret: %v", err)
+	}
 
 	s.ServeMux = http.DefaultServeMux
 	s.HandleFunc("/", s.Handler)
+	s.HandleFunc(CaptivePath, s.CaptiveAPI)
+	s.HandleFunc("/logout", s.Logout)
+	s.HandleFunc("/static/", s.Static)
 	s.Server = &http.Server{
-		Addr:    fmt.Sprintf("%s:%s", c.listenIP, c.ports.HTTP),
-		Handler: s,
+		Handler: http.HandlerFunc(s.HTTPHandler),
+	}
+	s.TLSServer = &http.Server{
+		Handler:   http.HandlerFunc(s.HTTPSHandler),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{c.certificate}},
 	}
 	return s
 }
 
+// ListenAndServe listens on the HTTP port of each listen address
+func (s *Server) ListenAndServe() error {
+	return s.serve(s.Server, s.ports.HTTP, false)
+}
+
+// ListenAndServeHTTPS listens on the HTTPS port of each listen address
+// with the configured certificate
+func (s *Server) ListenAndServeHTTPS() error {
+	return s.serve(s.TLSServer, s.ports.HTTPS, true)
+}
+
+// serve listens on a port of each listen address,
+// returning when any of them fails
+// If an address can't be listened on, none of them are served
+func (s *Server) serve(srv *http.Server, port string, secure bool) error {
+	listeners := []net.Listener{}
+	for _, ip := range s.listenIPs {
+		l, err := net.Listen("tcp", net.JoinHostPort(ip, port))
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+
+	done := make(chan error, len(listeners))
+	for _, l := range listeners {
+		l := l
+		go func() {
+			if secure {
+				done <- srv.ServeTLS(l, "", "")
+			} else {
+				done <- srv.Serve(l)
+			}
+		}()
+	}
+	return <-done
+}
+
+// HTTPHandler serves the portal over plain HTTP,
+// unless login has been restricted to HTTPS
+// Connectivity probes are always answered over plain HTTP
+func (s *Server) HTTPHandler(w http.ResponseWriter, req *http.Request) {
+	if _, ok := probeFor(req); !s.httpLogin && !ok {
+		debugf("redirecting plain HTTP request from %s", req.RemoteAddr)
+		u := s.PortalURL(req, "https", s.portalPath(req))
+		if param := s.returnParam(req); param != "" {
+			u += "?return=" + url.QueryEscape(param)
+		}
+		http.Redirect(w, req, u, http.StatusFound)
+		return
+	}
+	s.ServeMux.ServeHTTP(w, req)
+}
+
+// HTTPSHandler serves the portal over HTTPS when a certificate is configured,
+// otherwise it sends clients to the plain HTTP portal page
+// The captive portal API is always served over HTTPS
+func (s *Server) HTTPSHandler(w http.ResponseWriter, req *http.Request) {
+	if s.selfSigned && req.URL.Path != CaptivePath {
+		debugf("redirecting HTTPS request from %s", req.RemoteAddr)
+		http.Redirect(w, req, s.PortalURL(req, "http", s.portalPath(req)), http.StatusFound)
+		return
+	}
+	s.ServeMux.ServeHTTP(w, req)
+}
+
+// PortalURL returns the address of a portal page for a scheme,
+// on the listen address the request came in on
+func (s *Server) PortalURL(req *http.Request, scheme, path string) string {
+	ip := s.listenIPs[0]
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if local := remoteIP(addr.String()); local != nil {
+			ip = local.String()
+		}
+	}
+
+	if scheme == "https" {
+		host := certificateHost(s.certificate, ip)
+		return fmt.Sprintf("https://%s%s", net.JoinHostPort(host, s.ports.HTTPS), path)
+	}
+	return fmt.Sprintf("http://%s%s", net.JoinHostPort(ip, s.ports.HTTP), path)
+}
+
+// portalPath returns the path of a request meant for the portal,
+// e.g. of a portal, or the root for requests meant for other hosts
+func (s *Server) portalPath(req *http.Request) string {
+	if s.foreignHost(req) {
+		return "/"
+	}
+	return req.URL.Path
+}
+
 // IsLocal determines if the remote IP is part of the local network
-func (s Server) IsLocal(remote string) bool {
-	host := strings.Split(remote, ":")[0]
-	ip := net.ParseIP(host)
-	return s.localnet.Contains(ip)
+func (s *Server) IsLocal(remote string) bool {
+	ip := remoteIP(remote)
+	for _, localnet := range s.localnets {
+		if localnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Redirect redirects the user to the portal's or the server's redirect URL
+func (s *Server) Redirect(w http.ResponseWriter, req *http.Request) {
+	redirect := s.Portal(req).Redirect
+	if redirect == "" {
+		s.lock.RLock()
+		redirect = s.redirect
+		s.lock.RUnlock()
+	}
+	http.Redirect(w, req, redirect, http.StatusFound)
+}
+
+// render executes one of the current templates with a status,
+// in the language negotiated for the request
+// The templates are cloned for each page, so their funcs can be
+// bound to its language
+func (s *Server) render(w http.ResponseWriter, req *http.Request, status int, name string, data interface{}) {
+	s.lock.RLock()
+	templates, catalog := s.templates, s.catalog
+	s.lock.RUnlock()
+
+	lang := s.language(w, req)
+	t, err := templates.Clone()
+	if err != nil {
+		log.Printf("failed rendering %s: %v", name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	t.Funcs(template.FuncMap{
+		"t": func(id string, args ...interface{}) string {
+			return catalog.Translate(lang, id, args...)
+		},
+		"lang":      func() string { return lang },
+		"languages": func() []Language { return s.languages(req, lang) },
+	})
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := t.ExecuteTemplate(w, name, data); err != nil {
+		log.Printf("failed rendering %s: %v", name, err)
+	}
+}
+
+// translate returns a message in the language negotiated for the request
+func (s *Server) translate(req *http.Request, id string, args ...interface{}) string {
+	s.lock.RLock()
+	catalog := s.catalog
+	s.lock.RUnlock()
+	return catalog.Translate(catalog.Negotiate(req), id, args...)
+}
+
+// Static serves the files of the static directory next to the templates,
+// for logos and stylesheets
+func (s *Server) Static(w http.ResponseWriter, req *http.Request) {
+	s.lock.RLock()
+	static := s.static
+	s.lock.RUnlock()
+	if static == "" {
+		http.NotFound(w, req)
+		return
+	}
+	http.StripPrefix("/static/", http.FileServer(staticDir(static))).ServeHTTP(w, req)
 }
 
-// Redirect redirects the user to the server's redirect URL
-func (s Server) Redirect(w http.ResponseWriter, req *http.Request) {
-	http.Redirect(w, req, s.redirect, http.StatusFound)
+// DisplayMessage renders the login page of the request's portal
+// with the message of an ID, keeping track of the page the device was after
+// The acceptable use policy is shown if the portal has a clickthrough token
+func (s *Server) DisplayMessage(w http.ResponseWriter, req *http.Request, id string, args ...interface{}) {
+	portal := s.Portal(req)
+	data := struct {
+		Message, Return string
+		Portal          string
+		Clickthrough    bool
+		AUP, AUPVersion string
+	}{
+		Message: s.translate(req, id, args...),
+		Return:  s.returnParam(req),
+		Portal:  portal.Name,
+	}
+	if t, ok := s.ClickthroughToken(portal); ok {
+		data.Clickthrough = true
+		data.AUP = t.AUP
+		data.AUPVersion = t.AUPVersion
+	}
+	s.render(w, req, http.StatusOK, portal.Template, data)
 }
 
-// DisplayMessage renders the login page with a specified message
-func (s Server) DisplayMessage(w http.ResponseWriter, message string) {
-	s.templates.ExecuteTemplate(w, "index.html", struct{ Message string }{Message: message})
+// DisplayError renders the failure page with a status and the message of an ID
+func (s *Server) DisplayError(w http.ResponseWriter, req *http.Request, status int, id string) {
+	s.render(w, req, status, "error.html", struct{ Message string }{Message: s.translate(req, id)})
+}
+
+// DisplayStatus renders the session of an authorized device
+func (s *Server) DisplayStatus(w http.ResponseWriter, req *http.Request, hw net.HardwareAddr) {
+	session, ok := s.sessions.Session(hw)
+	if !ok {
+		s.DisplayMessage(w, req, "authorized")
+		return
+	}
+	status := struct {
+		Token     string
+		Networks  []string
+		Remaining string
+		CSRF      string
+	}{Token: session.Token, Networks: session.Networks, CSRF: s.logoutToken(hw, session)}
+	if !session.Expires.IsZero() {
+		status.Remaining = time.Until(session.Expires).Round(time.Second).String()
+	}
+	s.render(w, req, http.StatusOK, "status.html", status)
+}
+
+// logoutToken returns the token the sign out form of a session carries,
+// so other sites can't sign a device out
+func (s *Server) logoutToken(hw net.HardwareAddr, session Session) string {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "logout\x00%s\x00%d", hw, session.Authorized.UnixNano())
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Logout removes the calling device, so the next person
+// using it has to sign in
+// Requests meant for other hosts get the portal
+func (s *Server) Logout(w http.ResponseWriter, req *http.Request) {
+	if !s.IsLocal(req.RemoteAddr) {
+		debugf("redirecting non-local logout from %s", req.RemoteAddr)
+		s.Redirect(w, req)
+		return
+	}
+	if s.foreignHost(req) {
+		s.Handler(w, req)
+		return
+	}
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	hw, err := HardwareAddr(req.RemoteAddr)
+	if err != nil {
+		debugf("rejecting logout with indeterminate mac: %v", err)
+		s.DisplayMessage(w, req, "sign_out_failed")
+		return
+	}
+	if session, ok := s.sessions.Session(hw); ok || s.backend.HWAddrExists(hw) {
+		csrf := []byte(req.PostFormValue("csrf"))
+		if !hmac.Equal(csrf, []byte(s.logoutToken(hw, session))) {
+			debugf("rejecting logout of %s without a valid token", hw)
+			s.DisplayError(w, req, http.StatusForbidden, "sign_out_failed")
+			return
+		}
+		if err := s.Revoke(hw, "logged out"); err != nil {
+			log.Printf("failed logging out device %s: %v", hw, err)
+			s.DisplayError(w, req, http.StatusInternalServerError, "sign_out_retry")
+			return
+		}
+	}
+	s.DisplayMessage(w, req, "signed_out")
 }
 
 // Handler allows server to satisfy the http.Handler interface
-func (s Server) Handler(w http.ResponseWriter, req *http.Request) {
+func (s *Server) Handler(w http.ResponseWriter, req *http.Request) {
 	// Redirect any non-local requests
 	if !s.IsLocal(req.RemoteAddr) {
 		debugf("redirecting non-local request from %s", req.RemoteAddr)
@@ -64,16 +347,22 @@ func (s Server) Handler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// Answer connectivity probes, so clients open or close their sign-in sheet
+	if p, ok := probeFor(req); ok {
+		s.AnswerProbe(w, req, p)
+		return
+	}
+
 	switch req.Method {
 	case "GET":
-		// Redirect authorized devices
+		// Show authorized devices their session
 		hw, _ := HardwareAddr(req.RemoteAddr)
 		if s.backend.HWAddrExists(hw) {
-			debugf("redirecting GET from authorized device %s", hw)
-			s.DisplayMessage(w, "you are authorized")
+			debugf("showing status to authorized device %s", hw)
+			s.DisplayStatus(w, req, hw)
 			return
 		}
-		s.templates.ExecuteTemplate(w, "index.html", nil)
+		s.DisplayMessage(w, req, "")
 		return
 
 	case "POST":
@@ -81,7 +370,8 @@ func (s Server) Handler(w http.ResponseWriter, req *http.Request) {
 		hw, err := HardwareAddr(req.RemoteAddr)
 		if err != nil {
 			debugf("rejecting request with indeterminate mac: %v", err)
-			s.DisplayMessage(w, "unauthorized")
+			loginAttempts.WithLabelValues("unresolved_mac").Inc()
+			s.DisplayMessage(w, req, "unauthorized")
 			return
 		}
 
@@ -92,26 +382,51 @@ func (s Server) Handler(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
+		// Accepting the acceptable use policy needs no key
+		if req.PostFormValue("accept") != "" {
+			s.AcceptAUP(w, req, hw)
+			return
+		}
+
+		// Hold back devices which failed to log in recently
+		clients := []string{"mac " + hw.String(), "ip " + remoteIP(req.RemoteAddr).String()}
+		wait, done := s.limiter.Attempt(clients...)
+		if wait > 0 {
+			debugf("rejecting login from backed off device %s", hw)
+			loginAttempts.WithLabelValues("rate_limited").Inc()
+			s.DisplayMessage(w, req, "too_many_attempts", roundUp(wait))
+			return
+		}
+
 		// Reject unauthorized devices
-		token, err := s.Token(req.PostFormValue("key"))
-		if err != nil {
+		token, refund, err := s.Token(req.PostFormValue("key"))
+		if err == nil && !s.Portal(req).Allows(token.Name) {
+			refund()
+			err = fmt.Errorf("token %s isn't allowed on this portal", token.Name)
+		}
+		done(err == nil)
+		if errors.Is(err, errVoucherUsed) {
+			debugf("rejecting used up key: %v\n", err)
+			loginAttempts.WithLabelValues("used_key").Inc()
+			s.DisplayMessage(w, req, "key_used_up")
+			return
+		} else if err != nil {
 			debugf("rejecting invalid key: %v\n", err)
-			s.DisplayMessage(w, "unauthorized")
+			loginAttempts.WithLabelValues("bad_key").Inc()
+			s.DisplayMessage(w, req, "unauthorized")
 			return
 		}
 
-		// Authorize new device
-		s.backend.AddDevice(token.NetworkNames, Device{HardwareAddr: hw})
-		log.Printf("device %s authorized as %s", hw, token.Name)
-
-		// Defer removal of new device
-		if token.duration != 0 {
-			s.DeferRemoval(Device{HardwareAddr: hw}, token.duration)
-			log.Printf("device %s will be removed in %s", hw, token.duration.String())
+		// Reject tokens outside their validity or schedule
+		if !token.Active(time.Now()) {
+			refund()
+			debugf("rejecting inactive token %s", token.Name)
+			loginAttempts.WithLabelValues("inactive_token").Inc()
+			s.DisplayMessage(w, req, "key_inactive")
+			return
 		}
 
-		// Redirect to configured page
-		s.Redirect(w, req)
+		s.login(w, req, hw, token, refund)
 		return
 
 	default:
@@ -122,34 +437,439 @@ func (s Server) Handler(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// login authorizes a device for a token and sends it on,
+// giving back the key's use if that fails
+func (s *Server) login(w http.ResponseWriter, req *http.Request, hw net.HardwareAddr, token Token, refund func()) {
+	if err := s.Authorize(hw, token); errors.Is(err, errDeviceLimit) {
+		refund()
+		debugf("rejecting device %s: %v", hw, err)
+		loginAttempts.WithLabelValues("device_limit").Inc()
+		s.DisplayMessage(w, req, "too_many_devices")
+		return
+	} else if err != nil {
+		refund()
+		log.Printf("failed authorizing device %s as %s: %v", hw, token.Name, err)
+		s.DisplayError(w, req, http.StatusInternalServerError, "sign_in_failed")
+		return
+	}
+	loginAttempts.WithLabelValues("success").Inc()
+
+	// Redirect to the token's page, the original page or the configured page
+	s.RedirectAfterLogin(w, req, token)
+}
+
+// AcceptAUP authorizes a device which agreed to the acceptable use policy
+// of the portal's clickthrough token
+func (s *Server) AcceptAUP(w http.ResponseWriter, req *http.Request, hw net.HardwareAddr) {
+	token, ok := s.ClickthroughToken(s.Portal(req))
+	if !ok {
+		debugf("rejecting clickthrough from %s without a clickthrough token", hw)
+		loginAttempts.WithLabelValues("inactive_token").Inc()
+		s.DisplayMessage(w, req, "unauthorized")
+		return
+	}
+	if req.PostFormValue("agree") != "yes" {
+		debugf("rejecting clickthrough from %s without agreement", hw)
+		s.DisplayMessage(w, req, "agree_required")
+		return
+	}
+
+	log.Printf("device %s accepted the acceptable use policy of %s, version %q", hw, token.Name, token.AUPVersion)
+	s.login(w, req, hw, token, func() {})
+}
+
+// ClickthroughToken returns the first enabled clickthrough token
+// offered on a portal, if there is one within its validity and schedule
+func (s *Server) ClickthroughToken(portal Portal) (Token, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, t := range s.tokens {
+		if t.Type == "clickthrough" && !t.Disabled && t.Active(time.Now()) && offersClickthrough(s.portals, portal, t.Name) {
+			return t, true
+		}
+	}
+	return Token{}, false
+}
+
 // Token returns a token which matches the provided key
-func (s Server) Token(key string) (t Token, err error) {
-	for _, t = range s.tokens {
+// If the key is a voucher, or a key of a token with uses, a use is
+// used up, and calling refund gives it back
+func (s *Server) Token(key string) (t Token, refund func(), err error) {
+	refund = func() {}
+	t, stored, ok := s.keyToken(key)
+	if ok {
+		if t.Uses == 0 {
+			return t, refund, nil
+		}
+		if err = s.vouchers.RedeemKey(t.Name, stored, t.Uses); err != nil {
+			return
+		}
+		return t, s.refund(Voucher{Token: t.Name, Key: stored, Kind: keyUses}), nil
+	}
+
+	v, err := s.vouchers.Redeem(key)
+	if err != nil {
+		return
+	}
+	t, ok = s.TokenNamed(v.Token)
+	if !ok || t.Disabled || t.Type == "clickthrough" {
+		s.refund(v)()
+		return t, refund, fmt.Errorf("token %s of voucher isn't available", v.Token)
+	}
+	return t, s.refund(v), nil
+}
+
+// keyToken returns the enabled token with a key matching the provided key,
+// and the key as stored
+// Keys are compared in constant time, hashed or not
+func (s *Server) keyToken(key string) (Token, string, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, t := range s.tokens {
+		if t.Disabled {
+			continue
+		}
 		for _, k := range t.Keys {
-			if key == k {
-				return
+			if matchKey(k, key) {
+				return t, k, true
 			}
 		}
 	}
-	err = errors.New("no token found")
-	return
+	return Token{}, "", false
+}
+
+// refund returns a func giving back a use of a voucher
+func (s *Server) refund(v Voucher) func() {
+	return func() {
+		if err := s.vouchers.Refund(v); err != nil {
+			log.Printf("failed refunding voucher of token %s: %v", v.Token, err)
+		}
+	}
+}
+
+// TokenNamed returns the token with the given name
+func (s *Server) TokenNamed(name string) (Token, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, t := range s.tokens {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return Token{}, false
+}
+
+// TokenExists checks if a token with the given name is configured
+func (s *Server) TokenExists(name string) bool {
+	_, ok := s.TokenNamed(name)
+	return ok
+}
+
+// Tokens returns the tokens known to the server
+func (s *Server) Tokens() []Token {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.tokens
+}
+
+// AddToken makes a new token available until the next reload
+// It is checked along with the current tokens, as tokens from the config are
+func (s *Server) AddToken(t Token) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tokens := append(append([]Token{}, s.tokens...), t)
+	if err := parseTokens(tokens, s.backend.Networks()); err != nil {
+		return err
+	}
+	s.tokens = tokens
+	log.Printf("token %s added", t.Name)
+	return nil
+}
+
+// DisableToken stops a token from authorizing new devices
+// Devices already authorized by it keep their sessions
+func (s *Server) DisableToken(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	tokens := append([]Token{}, s.tokens...)
+	for i, t := range tokens {
+		if t.Name == name {
+			tokens[i].Disabled = true
+			s.tokens = tokens
+			log.Printf("token %s disabled", name)
+			return nil
+		}
+	}
+	return fmt.Errorf("token %s not found", name)
+}
+
+// errDeviceLimit is returned when a token has no room for another device
+var errDeviceLimit = errors.New("device limit reached")
+
+// Authorize grants a device access to the token's networks
+// and remembers it until the token's duration runs out
+func (s *Server) Authorize(hw net.HardwareAddr, token Token) error {
+	s.alock.Lock()
+	defer s.alock.Unlock()
+	if err := s.makeRoom(hw, token); err != nil {
+		return err
+	}
+
+	device := Device{HardwareAddr: hw, Token: token.Name, Added: time.Now()}
+	if err := s.backend.AddDevice(token.NetworkNames, device); err != nil {
+		return err
+	}
+	log.Printf("device %s authorized as %s", hw, token.Name)
+
+	// Remember the device across restarts
+	session := Session{HardwareAddr: hw.String(), Token: token.Name, Networks: token.NetworkNames, Authorized: device.Added}
+	if token.duration != 0 {
+		session.Expires = time.Now().Add(token.duration)
+	}
+	if err := s.sessions.Add(session); err != nil {
+		log.Printf("failed saving session for device %s: %v", hw, err)
+	}
+
+	// Defer removal of new device
+	if token.duration != 0 {
+		s.DeferRemoval(device, token.duration)
+		log.Printf("device %s will be removed in %s", hw, token.duration.String())
+	}
+	return nil
+}
+
+// makeRoom enforces a token's device limit before a device is added,
+// either rejecting the device or evicting the token's oldest devices
+// Devices are counted by their sessions, which suspended devices keep
+func (s *Server) makeRoom(hw net.HardwareAddr, token Token) error {
+	if token.MaxDevices == 0 {
+		return nil
+	}
+
+	bound := []Device{}
+	for _, session := range s.sessions.Sessions() {
+		if session.Token != token.Name || session.Expired() {
+			continue
+		}
+		d, err := net.ParseMAC(session.HardwareAddr)
+		if err != nil || bytes.Equal(d, hw) {
+			continue
+		}
+		bound = append(bound, session.Device(d))
+	}
+	if len(bound) < token.MaxDevices {
+		return nil
+	}
+	if token.OnLimit != "evict_oldest" {
+		return fmt.Errorf("%w: token %s allows %d devices", errDeviceLimit, token.Name, token.MaxDevices)
+	}
+
+	sort.Slice(bound, func(i, j int) bool { return bound[i].Added.Before(bound[j].Added) })
+	for _, d := range bound[:len(bound)-token.MaxDevices+1] {
+		if err := s.Revoke(d.HardwareAddr, "evicted by "+hw.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Revoke removes a device and forgets its session
+// If the backend fails, the session is kept so revoking can be retried
+func (s *Server) Revoke(hw net.HardwareAddr, reason string) error {
+	s.tlock.Lock()
+	if t, ok := s.timers[hw.String()]; ok {
+		t.Stop()
+		delete(s.timers, hw.String())
+	}
+	s.tlock.Unlock()
+
+	if err := s.backend.RemoveDevice(Device{HardwareAddr: hw}); err != nil {
+		return err
+	}
+	s.suspend(hw, false)
+	if err := s.sessions.Remove(hw); err != nil {
+		log.Printf("failed removing session for device %s: %v", hw, err)
+	}
+	log.Printf("device %s removed (%s)", hw, reason)
+	return nil
+}
+
+// Extend pushes back the expiry of a device's session
+func (s *Server) Extend(hw net.HardwareAddr, duration time.Duration) (Session, error) {
+	session, ok := s.sessions.Session(hw)
+	if !ok {
+		return session, fmt.Errorf("no session for device %s", hw)
+	}
+	if session.Expires.IsZero() {
+		return session, fmt.Errorf("session for device %s doesn't expire", hw)
+	}
+
+	if session.Expired() {
+		session.Expires = time.Now()
+	}
+	session.Expires = session.Expires.Add(duration)
+	if err := s.sessions.Add(session); err != nil {
+		return session, err
+	}
+
+	remaining := time.Until(session.Expires)
+	s.DeferRemoval(Device{HardwareAddr: hw}, remaining)
+	log.Printf("device %s will be removed in %s", hw, remaining.String())
+	return session, nil
 }
 
-// DeferRemoval will remove the specified device after a duration
-func (s Server) DeferRemoval(device Device, duration time.Duration) {
-	go time.AfterFunc(duration, func() {
-		s.backend.RemoveDevice(device)
-		log.Printf("device %s removed", device.HardwareAddr)
+// DeferRemoval will remove the specified device after a duration,
+// replacing any earlier removal of the same device
+// A replaced removal which already fired finds itself replaced and does nothing
+func (s *Server) DeferRemoval(device Device, duration time.Duration) {
+	hw := device.HardwareAddr
+	s.tlock.Lock()
+	defer s.tlock.Unlock()
+	if t, ok := s.timers[hw.String()]; ok {
+		t.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(duration, func() {
+		s.tlock.Lock()
+		current := s.timers[hw.String()] == timer
+		s.tlock.Unlock()
+		if !current {
+			return
+		}
+
+		expirations.Inc()
+		if err := s.Revoke(hw, "expired"); err != nil {
+			log.Printf("failed removing expired device %s: %v", hw, err)
+		}
 	})
+	s.timers[hw.String()] = timer
+}
+
+// Restore authorizes the devices from stored sessions
+// and re-arms their removal
+func (s *Server) Restore() {
+	for _, session := range s.sessions.Sessions() {
+		hw, err := net.ParseMAC(session.HardwareAddr)
+		if err != nil {
+			log.Printf("skipping session with invalid mac %s", session.HardwareAddr)
+			continue
+		}
+
+		token, ok := s.TokenNamed(session.Token)
+		if session.Expired() || !ok || token.Expired(time.Now()) {
+			debugf("discarding session for device %s", hw)
+			if err := s.sessions.Remove(hw); err != nil {
+				log.Printf("failed removing session for device %s: %v", hw, err)
+			}
+			continue
+		}
+
+		device := session.Device(hw)
+		if !token.Active(time.Now()) {
+			s.suspend(hw, true)
+			log.Printf("device %s restored as %s, suspended outside its schedule", hw, session.Token)
+		} else if err := s.backend.AddDevice(session.Networks, device); err != nil {
+			log.Printf("failed restoring device %s: %v", hw, err)
+			continue
+		} else {
+			log.Printf("device %s restored as %s", hw, session.Token)
+		}
+
+		if !session.Expires.IsZero() {
+			remaining := time.Until(session.Expires)
+			s.DeferRemoval(device, remaining)
+			log.Printf("device %s will be removed in %s", hw, remaining.String())
+		}
+	}
+}
+
+// Reload swaps in the tokens, redirect, templates, portals and messages
+// of a new config, revokes devices whose token is gone and regrants the rest,
+// since networks may have been recreated
+// The new token schedules are applied right away
+func (s *Server) Reload(c ServerConfig) {
+	s.lock.Lock()
+	s.tokens = c.tokens
+	s.redirect = c.redirect
+	s.templates = c.templates
+	s.static = c.static
+	s.portals = c.portals
+	s.catalog = c.catalog
+	s.lock.Unlock()
+	s.limiter.Configure(c.limits)
+
+	for _, session := range s.sessions.Sessions() {
+		hw, err := net.ParseMAC(session.HardwareAddr)
+		if err != nil {
+			continue
+		}
+		if !s.TokenExists(session.Token) {
+			if err := s.Revoke(hw, "token "+session.Token+" removed"); err != nil {
+				log.Printf("failed removing device %s: %v", hw, err)
+			}
+			continue
+		}
+		if s.Suspended(hw) {
+			continue
+		}
+		if err := s.backend.AddDevice(session.Networks, session.Device(hw)); err != nil {
+			log.Printf("failed regranting device %s: %v", hw, err)
+		}
+	}
+	s.applySchedule(time.Now())
 }
 
 // HardwareAddr returns the mac addr for a local IP, or an error
+// IPv4 addresses are looked up in the ARP table,
+// IPv6 addresses in the NDP neighbor table
 func HardwareAddr(remote string) (hw net.HardwareAddr, err error) {
-	addr := strings.Split(remote, ":")
-	ip := net.ParseIP(addr[0])
-	mac := arp.Search(ip.String())
+	ip := remoteIP(remote)
+	if ip == nil {
+		return nil, fmt.Errorf("unable to parse remote address %s", remote)
+	}
+	var mac string
+	if ip.To4() != nil {
+		mac = arp.Search(ip.String())
+	} else {
+		mac = neighborSearch(ip)
+	}
 	if mac == "" {
 		return nil, fmt.Errorf("unable to resolve hardware address for %s", ip.String())
 	}
 	return net.ParseMAC(mac)
 }
+
+// remoteIP parses the IP of a host:port address, dropping any IPv6 zone
+func remoteIP(remote string) net.IP {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	return net.ParseIP(host)
+}
+
+// neighborSearch returns the mac addr of an IPv6 neighbor,
+// as arp.Search does for IPv4
+func neighborSearch(ip net.IP) string {
+	out, err := exec.Command("ip", "-6", "neigh", "show", ip.String()).Output()
+	if err != nil {
+		return ""
+	}
+	return parseNeighbor(string(out))
+}
+
+// parseNeighbor returns the first mac addr of ip neigh output,
+// like "fd00::10 dev eth0 lladdr 00:11:22:33:44:55 REACHABLE"
+func parseNeighbor(out string) string {
+	fields := strings.Fields(out)
+	for i, f := range fields {
+		if f == "lladdr" && i+1 < len(fields) {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRemoteIP(t *testing.T) {
+	cases := map[string]string{
+		"192.168.1.10:51234":        "192.168.1.10",
+		"192.168.1.10":              "192.168.1.10",
+		"[fd00::10]:51234":          "fd00::10",
+		"[fe80::1%eth0]:51234":      "fe80::1",
+		"fe80::1%eth0":              "fe80::1",
+		"fd00::10":                  "fd00::10",
+		"[::ffff:192.168.1.10]:443": "192.168.1.10",
+	}
+	for remote, expected := range cases {
+		if ip := remoteIP(remote); ip == nil || ip.String() != expected {
+			t.Errorf("%s parsed as %v, expected %s", remote, ip, expected)
+		}
+	}
+	for _, bad := range []string{"", "example.com:80", "[fd00::10"} {
+		if ip := remoteIP(bad); ip != nil {
+			t.Errorf("%s parsed as %v", bad, ip)
+		}
+	}
+}
+
+func TestParseNeighbor(t *testing.T) {
+	cases := map[string]string{
+		"fd00::10 dev eth0 lladdr 00:11:22:33:44:55 REACHABLE\n":  "00:11:22:33:44:55",
+		"fe80::10 dev eth0 lladdr 00:11:22:33:44:55 router STALE": "00:11:22:33:44:55",
+		"fd00::10 dev eth0 FAILED\n":                              "",
+		"fd00::10 dev eth0 lladdr":                                "",
+		"":                                                        "",
+	}
+	for out, expected := range cases {
+		if hw := parseNeighbor(out); hw != expected {
+			t.Errorf("%q parsed as %q, expected %q", out, hw, expected)
+		}
+	}
+}
+
+func TestAddTokenConcurrently(t *testing.T) {
+	s := &Server{backend: NewMemBackend()}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.AddToken(Token{Name: "guest", Keys: []string{"welcome"}})
+		}()
+	}
+	wg.Wait()
+
+	if n := len(s.Tokens()); n != 1 {
+		t.Errorf("%d tokens added, expected 1", n)
+	}
+}
+
+func TestDeferRemovalReplaced(t *testing.T) {
+	ss, err := NewSessionStore(filepath.Join(t.TempDir(), "sessions.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		backend:   NewMemBackend(),
+		sessions:  ss,
+		timers:    map[string]*time.Timer{},
+		suspended: map[string]bool{},
+	}
+	hw, _ := net.ParseMAC("00:00:00:00:00:01")
+	device := Device{HardwareAddr: hw}
+	if err := ss.Add(Session{HardwareAddr: hw.String(), Token: "guest"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first removal fires while the timers are held,
+	// and is replaced before it gets hold of them, as by Extend
+	s.DeferRemoval(device, time.Millisecond)
+	s.tlock.Lock()
+	time.Sleep(20 * time.Millisecond)
+	s.timers[hw.String()] = time.NewTimer(time.Hour)
+	s.tlock.Unlock()
+	time.Sleep(20 * time.Millisecond)
+
+	if _, ok := ss.Session(hw); !ok {
+		t.Error("replaced removal removed the device")
+	}
+}
+
+func TestMakeRoomCountsSessions(t *testing.T) {
+	ss, err := NewSessionStore(filepath.Join(t.TempDir(), "sessions.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{backend: NewMemBackend(), sessions: ss}
+	token := Token{Name: "office", MaxDevices: 2}
+
+	// Suspended devices are out of the backend but keep their sessions
+	for _, mac := range []string{"00:00:00:00:00:01", "00:00:00:00:00:02"} {
+		ss.Add(Session{HardwareAddr: mac, Token: "office"})
+	}
+	ss.Add(Session{HardwareAddr: "00:00:00:00:00:03", Token: "guest"})
+	ss.Add(Session{HardwareAddr: "00:00:00:00:00:04", Token: "office", Expires: time.Now().Add(-time.Minute)})
+
+	known, _ := net.ParseMAC("00:00:00:00:00:01")
+	if err := s.makeRoom(known, token); err != nil {
+		t.Errorf("device with a session rejected: %v", err)
+	}
+	hw, _ := net.ParseMAC("00:00:00:00:00:05")
+	if err := s.makeRoom(hw, token); err == nil {
+		t.Error("device over the limit accepted")
+	}
+	token.MaxDevices = 3
+	if err := s.makeRoom(hw, token); err != nil {
+		t.Errorf("device within the limit rejected: %v", err)
+	}
+}
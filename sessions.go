@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Session represents an authorized device which survives restarts
+type Session struct {
+	HardwareAddr string    `json:"mac"`
+	Token        string    `json:"token"`
+	Networks     []string  `json:"networks"`
+	Expires      time.Time `json:"expires"`
+	Authorized   time.Time `json:"authorized"`
+}
+
+// Expired determines if the session has run out
+func (s Session) Expired() bool {
+	return !s.Expires.IsZero() && time.Now().After(s.Expires)
+}
+
+// Device returns the backend device for the session
+func (s Session) Device(hw net.HardwareAddr) Device {
+	return Device{HardwareAddr: hw, Token: s.Token, Added: s.Authorized}
+}
+
+// SessionStore persists sessions to a JSON file
+type SessionStore struct {
+	path     string
+	sessions map[string]Session
+	lock     sync.Mutex
+}
+
+// NewSessionStore loads a session store from path,
+// which doesn't need to exist yet
+func NewSessionStore(path string) (*SessionStore, error) {
+	s := &SessionStore{
+		path:     path,
+		sessions: map[string]Session{},
+		lock:     sync.Mutex{},
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []Session{}
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		s.sessions[session.HardwareAddr] = session
+	}
+	return s, nil
+}
+
+// Sessions returns the stored sessions ordered by mac addr
+func (s *SessionStore) Sessions() []Session {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.list()
+}
+
+// Session returns the session for a device
+func (s *SessionStore) Session(hw net.HardwareAddr) (Session, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session, ok := s.sessions[hw.String()]
+	return session, ok
+}
+
+// Add stores a session, replacing any session for the same device
+func (s *SessionStore) Add(session Session) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sessions[session.HardwareAddr] = session
+	return s.save()
+}
+
+// Remove forgets the session for a device
+func (s *SessionStore) Remove(hw net.HardwareAddr) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.sessions[hw.String()]; !ok {
+		return nil
+	}
+	delete(s.sessions, hw.String())
+	return s.save()
+}
+
+func (s *SessionStore) list() []Session {
+	sessions := []Session{}
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].HardwareAddr < sessions[j].HardwareAddr
+	})
+	return sessions
+}
+
+// Write the sessions to a temporary file and move it into place,
+// so a crash never leaves a truncated store behind
+func (s *SessionStore) save() error {
+	data, err := json.MarshalIndent(s.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -12,9 +12,12 @@ type Network struct {
 }
 
 // Device represents a device that can access the portal
+// along with the token which authorized it and when
 type Device struct {
 	Name string
 	net.HardwareAddr
+	Token string
+	Added time.Time
 }
 
 // ListNetworks can enumnerate its networks
@@ -25,31 +28,78 @@ type ListNetworks interface {
 // Networks can ListNetworks and add/remove networks
 type Networks interface {
 	ListNetworks
-	AddNetwork(network Network)
-	RemoveNetwork(network Network)
+	AddNetwork(network Network) error
+	RemoveNetwork(network Network) error
 }
 
 // Devices can manage devices
 type Devices interface {
 	HWAddrExists(hw net.HardwareAddr) bool
-	AddDevice(networks []string, device Device) // error?
-	RemoveDevice(device Device)                 // error?
+	Devices() []Device
+	AddDevice(networks []string, device Device) error
+	RemoveDevice(device Device) error
+}
+
+// Counter represents traffic counted by a backend
+type Counter struct {
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// Counters can report traffic to each network
+type Counters interface {
+	NetworkCounters() (map[string]Counter, error)
+}
+
+// DeviceCounters can report traffic from each device by mac addr
+type DeviceCounters interface {
+	DeviceCounters() (map[string]Counter, error)
 }
 
 // Backend represents a firewall interface, e.g. iptables
 type Backend interface {
 	Networks
 	Devices
-	Open()
-	Close()
+	Open() error
+	Close() error
 }
 
 // Token represents a token which can be used to gain access to networks by devices
 type Token struct {
 	Name         string   `json:"name"`
+	Type         string   `json:"type,omitempty"`
 	Duration     string   `json:"duration"`
 	Keys         []string `json:"keys"`
 	NetworkNames []string `json:"networks"`
+	Disabled     bool     `json:"disabled"`
+	MaxDevices   int      `json:"max_devices,omitempty"`
+	OnLimit      string   `json:"on_limit,omitempty"`
+	Uses         int      `json:"uses,omitempty"`
+	ValidFrom    string   `json:"valid_from,omitempty"`
+	ValidUntil   string   `json:"valid_until,omitempty"`
+	Schedule     []string `json:"schedule,omitempty"`
+	IdleTimeout  string   `json:"idle_timeout,omitempty"`
+	Redirect     string   `json:"redirect,omitempty"`
+	AUP          string   `json:"aup,omitempty"`
+	AUPVersion   string   `json:"aup_version,omitempty"`
+
+	duration    time.Duration
+	idleTimeout time.Duration
+	validFrom   time.Time
+	validUntil  time.Time
+	windows     []Window
+}
+
+// Portal represents a login page for an audience, chosen by the path
+// devices visit or the subnet they're on, with its own template,
+// allowed tokens and redirect
+type Portal struct {
+	Name       string   `json:"name"`
+	Path       string   `json:"path,omitempty"`
+	Subnets    []string `json:"subnets,omitempty"`
+	Template   string   `json:"template,omitempty"`
+	TokenNames []string `json:"tokens,omitempty"`
+	Redirect   string   `json:"redirect,omitempty"`
 
-	duration time.Duration
+	subnets []*net.IPNet
 }
@@ -2,15 +2,59 @@ package main
 
 import (
 	"html/template"
-	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
-func getTemplates() *template.Template {
-	t, err := template.New("foo").Parse(`{{define "index.html"}}
-<!DOCTYPE html>
-<html lang="en" charset="utf-8">
-<head>
-	<title>Sign In</title>
+// staticDir serves the files of a directory, but not
+// directory listings or names starting with a dot
+type staticDir string
+
+// Open fulfills the http.FileSystem interface
+func (d staticDir) Open(name string) (http.File, error) {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return nil, os.ErrNotExist
+		}
+	}
+	f, err := http.Dir(d).Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		f.Close()
+		return nil, os.ErrNotExist
+	}
+	return f, nil
+}
+
+// templateFuncs are replaced for each page with ones in the page's language
+var templateFuncs = template.FuncMap{
+	"t":         func(id string, args ...interface{}) string { return id },
+	"lang":      func() string { return defaultLanguage },
+	"languages": func() []Language { return nil },
+}
+
+// getTemplates parses the embedded templates, then any *.html files in dir
+// A file replaces the embedded template of the same name, and can
+// redefine shared templates such as "head" or "aup"
+// Templates translate messages with {{t "id"}}, see i18n.go
+func getTemplates(dir string) (*template.Template, error) {
+	t, err := template.New("stargate").Funcs(templateFuncs).Parse(defaultTemplates)
+	if err != nil || dir == "" {
+		return t, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil || len(files) == 0 {
+		return t, err
+	}
+	return t.ParseFiles(files...)
+}
+
+const defaultTemplates = `{{define "head"}}
 	<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=no">
 	<style>
 	body {
@@ -76,6 +120,19 @@ func getTemplates() *template.Template {
 		margin:0;
 		box-sizing: border-box;
 	}
+	input[type=checkbox] {
+		display: inline;
+		width: auto;
+		height: auto;
+		margin-right: 5px;
+		box-shadow: none;
+	}
+	.aup {
+		white-space: pre-wrap;
+		max-height: 300px;
+		overflow-y: auto;
+		margin-bottom: 10px;
+	}
 	footer {
 		display:block;
 		font-size:10px;
@@ -94,6 +151,14 @@ func getTemplates() *template.Template {
 		color:#aaa;
 	}
 	</style>
+{{end}}
+
+{{define "index.html"}}
+<!DOCTYPE html>
+<html lang="{{lang}}" charset="utf-8">
+<head>
+	<title>{{t "sign_in_title"}}</title>
+	{{template "head"}}
 </head>
 <body>
 	{{ if .Message }}
@@ -102,20 +167,76 @@ func getTemplates() *template.Template {
 	</div>
 	{{ end}}
 
+	{{ if .Clickthrough }}
 	<div class="signin">
 	<form method="POST" action="">
-		<label for="password">enter key</label><input type="password" name="key" id="key" size="10" maxlength="30"><br/>
-		<button type="submit" class="btn">sign in</button>
+		{{ if .Return }}<input type="hidden" name="return" value="{{.Return}}">{{ end }}
+		<div class="aup">{{template "aup" .}}</div>
+		<label><input type="checkbox" name="agree" value="yes" required>{{t "agree"}}</label><br/>
+		<button type="submit" name="accept" value="yes" class="btn">{{t "continue"}}</button>
+	</form>
+	</div>
+	{{ end }}
+
+	<div class="signin">
+	<form method="POST" action="">
+		{{ if .Return }}<input type="hidden" name="return" value="{{.Return}}">{{ end }}
+		<label for="password">{{t "enter_key"}}</label><input type="password" name="key" id="key" size="10" maxlength="30"><br/>
+		<button type="submit" class="btn">{{t "sign_in"}}</button>
 	</form>
 	</div>
 	<footer>
+	{{template "languages"}}
 	</footer>
 </body>
 </html>
-{{end}}`)
+{{end}}
 
-	if err != nil {
-		log.Fatalf("failed parsing template %s", err)
-	}
-	return t
-}
+{{define "aup"}}{{.AUP}}{{end}}
+
+{{define "languages"}}{{ $langs := languages }}{{ if gt (len $langs) 1 }}{{range $langs}}
+	{{ if .Current }}<span>{{.Name}}</span>{{ else }}<a href="{{.URL}}" hreflang="{{.Code}}">{{.Name}}</a>{{ end }}{{end}}{{ end }}{{end}}
+
+{{define "status.html"}}
+<!DOCTYPE html>
+<html lang="{{lang}}" charset="utf-8">
+<head>
+	<title>{{t "signed_in_title"}}</title>
+	{{template "head"}}
+</head>
+<body>
+	<div class="signin">
+	<p><label>{{t "signed_in"}}</label></p>
+	<p>{{t "key"}}: {{.Token}}</p>
+	{{ if .Networks }}<p>{{t "networks"}}: {{range $i, $n := .Networks}}{{if $i}}, {{end}}{{$n}}{{end}}</p>{{ end }}
+	<p>{{t "time_remaining"}}: {{ if .Remaining }}{{.Remaining}}{{ else }}{{t "unlimited"}}{{ end }}</p>
+	<form method="POST" action="/logout">
+		<input type="hidden" name="csrf" value="{{.CSRF}}">
+		<button type="submit" class="btn">{{t "sign_out"}}</button>
+	</form>
+	</div>
+	<footer>
+	{{template "languages"}}
+	</footer>
+</body>
+</html>
+{{end}}
+
+{{define "error.html"}}
+<!DOCTYPE html>
+<html lang="{{lang}}" charset="utf-8">
+<head>
+	<title>{{t "error_title"}}</title>
+	{{template "head"}}
+</head>
+<body>
+	<div class="signin center">
+	<p><label>{{.Message}}</label></p>
+	<p><a class="btn" href="/">{{t "try_again"}}</a></p>
+	</div>
+	<footer>
+	{{template "languages"}}
+	</footer>
+</body>
+</html>
+{{end}}`
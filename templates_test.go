@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTemplatesOverride(t *testing.T) {
+	dir := t.TempDir()
+	index := `{{define "head"}}<link rel="stylesheet" href="/static/brand.css">{{end}}<h1>Welcome to the office</h1>{{template "head"}}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte(index), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	templates, err := getTemplates(dir)
+	if err != nil {
+		t.Fatalf("templates failed: %v", err)
+	}
+	var out bytes.Buffer
+	if err := templates.ExecuteTemplate(&out, "index.html", nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Welcome to the office") || strings.Contains(out.String(), "enter_key") {
+		t.Errorf("index.html not replaced: %s", out.String())
+	}
+
+	// Embedded pages use the redefined head
+	out.Reset()
+	if err := templates.ExecuteTemplate(&out, "error.html", struct{ Message string }{"oops"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "brand.css") {
+		t.Errorf("head not replaced: %s", out.String())
+	}
+}
+
+func TestStaticDir(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "img"), 0755)
+	os.MkdirAll(filepath.Join(dir, ".git"), 0755)
+	for _, name := range []string{"brand.css", "img/logo.png", ".htpasswd", ".git/config"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs := http.FileServer(staticDir(dir))
+	cases := map[string]int{
+		"/brand.css":    http.StatusOK,
+		"/img/logo.png": http.StatusOK,
+		"/":             http.StatusNotFound,
+		"/img/":         http.StatusNotFound,
+		"/.htpasswd":    http.StatusNotFound,
+		"/.git/config":  http.StatusNotFound,
+		"/missing.css":  http.StatusNotFound,
+	}
+	for path, status := range cases {
+		w := httptest.NewRecorder()
+		fs.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != status {
+			t.Errorf("%s served with %d, expected %d", path, w.Code, status)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+)
+
+// selfSignedCertificate generates a certificate for the listen addresses
+// which is good for a year
+func selfSignedCertificate(ips []string) (tls.Certificate, error) {
+	addrs := []net.IP{}
+	for _, ip := range ips {
+		addr := net.ParseIP(ip)
+		if addr == nil {
+			return tls.Certificate{}, errors.New("listen address can't be parsed as ip")
+		}
+		addrs = append(addrs, addr)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "stargate"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IPAddresses:           addrs,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
+
+// certificateLeaf returns the parsed leaf of a certificate, if any
+func certificateLeaf(cert tls.Certificate) *x509.Certificate {
+	if len(cert.Certificate) == 0 {
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil
+	}
+	return leaf
+}
+
+// certificateHost returns the first host name a certificate is valid for,
+// falling back to the provided address
+// Wildcard names are skipped, as they can't be linked to
+func certificateHost(cert tls.Certificate, fallback string) string {
+	leaf := certificateLeaf(cert)
+	if leaf == nil {
+		return fallback
+	}
+	for _, name := range leaf.DNSNames {
+		if !strings.Contains(name, "*") {
+			return name
+		}
+	}
+	return fallback
+}
+
+// certificateCovers checks if a certificate is valid for a host name,
+// matching wildcard names as a client would
+func certificateCovers(cert tls.Certificate, host string) bool {
+	leaf := certificateLeaf(cert)
+	return leaf != nil && len(leaf.DNSNames) > 0 && leaf.VerifyHostname(host) == nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// namedCertificate returns a certificate for DNS names
+func namedCertificate(t *testing.T, names ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     names,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestCertificateHost(t *testing.T) {
+	cases := []struct {
+		names []string
+		host  string
+	}{
+		{nil, "192.168.1.1"},
+		{[]string{"portal.example.com"}, "portal.example.com"},
+		{[]string{"*.example.com"}, "192.168.1.1"},
+		{[]string{"*.example.com", "portal.example.com"}, "portal.example.com"},
+	}
+	for _, c := range cases {
+		if host := certificateHost(namedCertificate(t, c.names...), "192.168.1.1"); host != c.host {
+			t.Errorf("%v gave host %s, expected %s", c.names, host, c.host)
+		}
+	}
+	if host := certificateHost(tls.Certificate{}, "192.168.1.1"); host != "192.168.1.1" {
+		t.Errorf("no certificate gave host %s", host)
+	}
+}
+
+func TestForeignHostWildcard(t *testing.T) {
+	s := &Server{}
+	s.listenIPs = []string{"192.168.1.1"}
+	s.certificate = namedCertificate(t, "*.example.com")
+	cases := map[string]bool{
+		"portal.example.com":      false,
+		"Portal.Example.com:7677": false,
+		"example.com":             true,
+		"a.portal.example.com":    true,
+		"example.org":             true,
+	}
+	for host, foreign := range cases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = host
+		if s.foreignHost(req) != foreign {
+			t.Errorf("%s foreign is %v, expected %v", host, !foreign, foreign)
+		}
+	}
+}
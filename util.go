@@ -1,6 +1,11 @@
 package main
 
-import "log"
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"time"
+)
 
 func debugf(format string, v ...interface{}) {
 	if debug {
@@ -8,29 +13,61 @@ func debugf(format string, v ...interface{}) {
 	}
 }
 
-// SyncNetworks copies networks from dst to src
-func SyncNetworks(dst Networks, src ListNetworks) {
+// SyncNetworks copies networks from src to dst
+// A network whose address changed is removed and added again
+func SyncNetworks(dst Networks, src ListNetworks) error {
 	// delete unused networks
 	for _, dstnet := range dst.Networks() {
-		for _, srcnet := range src.Networks() {
-			if dstnet.Name == srcnet.Name {
-				continue
+		if !containsNetwork(src.Networks(), dstnet) {
+			if err := dst.RemoveNetwork(dstnet); err != nil {
+				return fmt.Errorf("failed removing network %s: %v", dstnet.Name, err)
 			}
-			dst.RemoveNetwork(dstnet)
 		}
 	}
 
 	// add remaining networks
 	for _, srcnet := range src.Networks() {
-		exists := false
-		for _, dstnet := range dst.Networks() {
-			if srcnet.Name == dstnet.Name {
-				exists = true
-				break
+		if !containsNetwork(dst.Networks(), srcnet) {
+			if err := dst.AddNetwork(srcnet); err != nil {
+				return fmt.Errorf("failed adding network %s: %v", srcnet.Name, err)
 			}
 		}
-		if !exists {
-			dst.AddNetwork(srcnet)
+	}
+	return nil
+}
+
+// firstError returns the first error which isn't nil
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// containsNetwork checks for a network with the same name and address
+func containsNetwork(networks []Network, network Network) bool {
+	for _, n := range networks {
+		if n.Name == network.Name && n.String() == network.String() {
+			return true
 		}
 	}
+	return false
+}
+
+// withoutDevice returns the devices which don't share the device's mac addr
+func withoutDevice(devices []Device, device Device) []Device {
+	remaining := []Device{}
+	for _, d := range devices {
+		if !bytes.Equal(d.HardwareAddr, device.HardwareAddr) {
+			remaining = append(remaining, d)
+		}
+	}
+	return remaining
+}
+
+// roundUp rounds a duration up to the second, for display
+func roundUp(d time.Duration) time.Duration {
+	return (d + time.Second - 1).Truncate(time.Second)
 }
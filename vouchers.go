@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// Voucher is a key which admits a limited number of devices
+// Uses counts down as the voucher is redeemed
+// The uses left of a token's own keys are kept as vouchers of kind "key",
+// which can't be redeemed as vouchers, since they store the key
+// as configured, which may be a hash
+type Voucher struct {
+	Token string `json:"token"`
+	Key   string `json:"key"`
+	Uses  int    `json:"uses"`
+	Kind  string `json:"kind,omitempty"`
+}
+
+// keyUses is the kind of the vouchers counting uses of a token's keys
+const keyUses = "key"
+
+var errVoucherUsed = errors.New("voucher used up")
+
+// VoucherStore keeps the remaining uses of vouchers in a JSON file
+// The file is locked while it changes, so vouchers can be generated
+// while stargate is running
+type VoucherStore struct {
+	path string
+	lock sync.Mutex
+}
+
+// NewVoucherStore returns a voucher store at path,
+// which doesn't need to exist yet
+func NewVoucherStore(path string) *VoucherStore {
+	return &VoucherStore{path: path}
+}
+
+// Add stores new vouchers
+func (v *VoucherStore) Add(vouchers ...Voucher) error {
+	return v.update(func(stored []Voucher) ([]Voucher, error) {
+		for _, voucher := range vouchers {
+			for _, s := range stored {
+				if s.Key == voucher.Key {
+					return nil, errors.New("voucher key already exists")
+				}
+			}
+		}
+		return append(stored, vouchers...), nil
+	})
+}
+
+// Redeem uses up one use of a generated voucher and returns it
+func (v *VoucherStore) Redeem(key string) (voucher Voucher, err error) {
+	err = v.update(func(stored []Voucher) ([]Voucher, error) {
+		for i, s := range stored {
+			if s.Kind == keyUses || s.Key != key {
+				continue
+			}
+			if s.Uses <= 0 {
+				return nil, errVoucherUsed
+			}
+			stored[i].Uses--
+			voucher = s
+			return stored, nil
+		}
+		return nil, errors.New("no voucher found")
+	})
+	return
+}
+
+// RedeemKey uses up one use of a token's key
+// A key is stored with the token's uses the first time it is redeemed
+func (v *VoucherStore) RedeemKey(token, key string, uses int) error {
+	return v.update(func(stored []Voucher) ([]Voucher, error) {
+		for i, s := range stored {
+			if s.Kind == keyUses && s.Token == token && s.Key == key {
+				if s.Uses <= 0 {
+					return nil, errVoucherUsed
+				}
+				stored[i].Uses--
+				return stored, nil
+			}
+		}
+		return append(stored, Voucher{Token: token, Key: key, Uses: uses - 1, Kind: keyUses}), nil
+	})
+}
+
+// Refund gives back a use of a voucher, or of a token's key,
+// which didn't authorize a device
+func (v *VoucherStore) Refund(voucher Voucher) error {
+	return v.update(func(stored []Voucher) ([]Voucher, error) {
+		for i, s := range stored {
+			if s.Kind == voucher.Kind && s.Token == voucher.Token && s.Key == voucher.Key {
+				stored[i].Uses++
+			}
+		}
+		return stored, nil
+	})
+}
+
+// update applies a change to the stored vouchers while holding
+// the store's lock file, then writes them back
+// Nothing is written if the change fails
+func (v *VoucherStore) update(change func([]Voucher) ([]Voucher, error)) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(v.path), 0700); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(v.path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	stored := []Voucher{}
+	data, err := ioutil.ReadFile(v.path)
+	if err == nil {
+		err = json.Unmarshal(data, &stored)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	stored, err = change(stored)
+	if err != nil {
+		return err
+	}
+
+	data, err = json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := v.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, v.path)
+}
+
+// Voucher keys avoid characters which are easily misread on paper
+const voucherAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// newVoucherKey returns a random key like "k7qm-x3ta"
+func newVoucherKey() (string, error) {
+	key := []byte{}
+	for i := 0; i < 8; i++ {
+		if i == 4 {
+			key = append(key, '-')
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(voucherAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		key = append(key, voucherAlphabet[n.Int64()])
+	}
+	return string(key), nil
+}
+
+var voucherSheet = template.Must(template.New("vouchers").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Token}} vouchers</title>
+<style>
+body { font-family: "Helvetica Neue",Helvetica,Arial,sans-serif; }
+.voucher { display: inline-block; width: 30%; margin: 4px; padding: 12px; border: 1px dashed #999; page-break-inside: avoid; }
+.key { font-family: monospace; font-size: 20px; }
+</style>
+</head>
+<body>
+{{range .Vouchers}}<div class="voucher">
+<div>{{.Token}}</div>
+<div class="key">{{.Key}}</div>
+<div>{{if eq .Uses 1}}1 device{{else}}{{.Uses}} devices{{end}}</div>
+</div>
+{{end}}</body>
+</html>
+`))
+
+// vouchersCommand runs the vouchers subcommands
+func vouchersCommand(args []string) error {
+	if len(args) == 0 || args[0] != "generate" {
+		return errors.New("usage: stargate vouchers generate --token <name> [--count n] [--uses n] [--format csv|html]")
+	}
+
+	fs := flag.NewFlagSet("vouchers generate", flag.ExitOnError)
+	name := fs.String("token", "", "token the vouchers grant")
+	count := fs.Int("count", 1, "number of vouchers")
+	uses := fs.Int("uses", 1, "devices each voucher admits")
+	format := fs.String("format", "csv", "sheet format: csv or html")
+	fs.Parse(args[1:])
+
+	if *count < 1 || *uses < 1 {
+		return errors.New("count and uses must be positive")
+	}
+	if *format != "csv" && *format != "html" {
+		return fmt.Errorf("unknown format %s", *format)
+	}
+
+	cfg, err := ParseConfig()
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, t := range cfg.Tokens {
+		if t.Name != *name {
+			continue
+		}
+		if t.Type == "clickthrough" {
+			return fmt.Errorf("token %s is a clickthrough token, which takes no keys", *name)
+		}
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("token %s not found in %s", *name, cfile)
+	}
+
+	vouchers := []Voucher{}
+	for i := 0; i < *count; i++ {
+		key, err := newVoucherKey()
+		if err != nil {
+			return err
+		}
+		vouchers = append(vouchers, Voucher{Token: *name, Key: key, Uses: *uses})
+	}
+	if err := NewVoucherStore(filepath.Join(sdir, "vouchers.json")).Add(vouchers...); err != nil {
+		return err
+	}
+
+	if *format == "html" {
+		return voucherSheet.Execute(os.Stdout, struct {
+			Token    string
+			Vouchers []Voucher
+		}{*name, vouchers})
+	}
+	return writeVoucherCSV(os.Stdout, vouchers)
+}
+
+// writeVoucherCSV writes vouchers as CSV with a header row
+func writeVoucherCSV(w io.Writer, vouchers []Voucher) error {
+	c := csv.NewWriter(w)
+	c.Write([]string{"token", "key", "uses"})
+	for _, v := range vouchers {
+		c.Write([]string{v.Token, v.Key, fmt.Sprint(v.Uses)})
+	}
+	c.Flush()
+	return c.Error()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestVoucherStore(t *testing.T) {
+	v := NewVoucherStore(filepath.Join(t.TempDir(), "vouchers.json"))
+	if err := v.Add(Voucher{Token: "guest", Key: "k7qm-x3ta", Uses: 2}); err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	if err := v.Add(Voucher{Token: "guest", Key: "k7qm-x3ta", Uses: 1}); err == nil {
+		t.Error("duplicate voucher added")
+	}
+
+	for i := 0; i < 2; i++ {
+		if voucher, err := v.Redeem("k7qm-x3ta"); err != nil || voucher.Token != "guest" {
+			t.Fatalf("redeem %d failed: %v", i, err)
+		}
+	}
+	if _, err := v.Redeem("k7qm-x3ta"); !errors.Is(err, errVoucherUsed) {
+		t.Errorf("used up voucher redeemed: %v", err)
+	}
+	if err := v.Refund(Voucher{Token: "guest", Key: "k7qm-x3ta"}); err != nil {
+		t.Fatalf("refund failed: %v", err)
+	}
+	if _, err := v.Redeem("k7qm-x3ta"); err != nil {
+		t.Errorf("refunded voucher not redeemed: %v", err)
+	}
+	if _, err := v.Redeem("nope-nope"); err == nil {
+		t.Error("unknown voucher redeemed")
+	}
+}
+
+func TestVoucherStoreKeyUses(t *testing.T) {
+	v := NewVoucherStore(filepath.Join(t.TempDir(), "vouchers.json"))
+	hash := "$argon2id$v=19$m=19456,t=2,p=1$dq79ZPLMjYccgYgdegsCdA$pK1s1PuBamC3upLeOSPk3CpM4IMr/EguOgRPLZSGhxA"
+
+	for i := 0; i < 2; i++ {
+		if err := v.RedeemKey("security", hash, 2); err != nil {
+			t.Fatalf("redeem key %d failed: %v", i, err)
+		}
+	}
+	if err := v.RedeemKey("security", hash, 2); !errors.Is(err, errVoucherUsed) {
+		t.Errorf("used up key redeemed: %v", err)
+	}
+	if err := v.Refund(Voucher{Token: "security", Key: hash, Kind: keyUses}); err != nil {
+		t.Fatalf("refund failed: %v", err)
+	}
+	if err := v.RedeemKey("security", hash, 2); err != nil {
+		t.Errorf("refunded key not redeemed: %v", err)
+	}
+
+	// The stored key, a hash, must not work as a voucher
+	if err := v.Refund(Voucher{Token: "security", Key: hash, Kind: keyUses}); err != nil {
+		t.Fatalf("refund failed: %v", err)
+	}
+	if _, err := v.Redeem(hash); err == nil {
+		t.Error("key uses redeemed as a voucher")
+	}
+}